@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and clean the downloaded assets in the save assets path",
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the cached assets",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load config: %s", err)
+		}
+
+		assets, err := lib.NewAssetCache(config.SaveAssetsPath).List()
+		if err != nil {
+			return err
+		}
+		printCachedAssets(assets)
+		return nil
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the cached assets out of the retention policy",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load config: %s", err)
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+
+		state, err := lib.NewState(config)
+		if err != nil {
+			return err
+		}
+
+		removed, err := pruneAssets(config, state, lib.NewAssetCache(config.SaveAssetsPath), dryRun)
+		if err != nil {
+			return err
+		}
+		printCachedAssets(removed)
+		return nil
+	},
+}
+
+func printCachedAssets(assets []*lib.CachedAsset) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tSIZE\tDOWNLOADED\tDEPLOYED\tPATH")
+	for _, a := range assets {
+		deployed := "-"
+		if !a.DeployedAt.IsZero() {
+			deployed = a.DeployedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", a.Tag, a.Size, a.DownloadedAt.Format(time.RFC3339), deployed, a.Path)
+	}
+	w.Flush()
+}
+
+func init() {
+	cachePruneCmd.Flags().Bool("dry-run", false, "only print the assets to be removed")
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
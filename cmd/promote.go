@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote [tag]",
+	Short: "Promote the release waiting for manual promotion to stable",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load config: %s", err)
+		}
+
+		state, err := lib.NewState(config)
+		if err != nil {
+			return err
+		}
+
+		tag := ""
+		if len(args) > 0 {
+			tag = args[0]
+		}
+		info, err := state.Promote(tag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("promoted %s to stable\n", info.Tag)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(promoteCmd)
+}
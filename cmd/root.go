@@ -11,8 +11,10 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -29,9 +31,12 @@ import (
 
 var cfgFile string
 
+// deployments reports the releases to GitHub, it is nil unless deployment_environment is configured
+var deployments *lib.DeploymentReporter
+
 var rootCmd = &cobra.Command{
 	Use:   "git-assets-canary-releaser",
-	Short: "This command downloads release assets from GitHub and deploys them.",
+	Short: "This command downloads release assets from GitHub or GitLab and deploys them.",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
 		config, err := loadConfig()
@@ -47,7 +52,11 @@ var rootCmd = &cobra.Command{
 		}
 		slog.SetDefault(logger)
 
-		if err := runServer(config); err != nil {
+		// the release source calls are cancelled on shutdown, the running hook commands are not interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := runServer(ctx, config); err != nil {
 			slog.Error(fmt.Sprintf("failed to run server: %s", err))
 			// wait for slack notification
 			// https://github.com/samber/slog-slack/blob/main/handler.go#L89
@@ -59,10 +68,10 @@ var rootCmd = &cobra.Command{
 	},
 }
 
-func deploy(cmd, targetTag string, state *lib.State, github lib.GitHuber) (string, string, error) {
-	tag, downloadFile, err := github.DownloadReleaseAsset(targetTag)
+func deploy(ctx context.Context, cmd, targetTag string, state *lib.State, source lib.ReleaseSource) (string, string, error) {
+	tag, downloadFile, err := source.DownloadReleaseAsset(ctx, targetTag)
 	if err != nil {
-		return "", "", fmt.Errorf("can't get release asset:%s %s", tag, err)
+		return "", "", fmt.Errorf("can't get release asset:%s %w", tag, err)
 	}
 
 	currentVersion, err := state.GetLastInstalledTag()
@@ -79,7 +88,7 @@ func deploy(cmd, targetTag string, state *lib.State, github lib.GitHuber) (strin
 	return tag, downloadFile, nil
 }
 
-func handleRollout(config *lib.Config, github lib.GitHuber, state *lib.State) error {
+func handleRollout(ctx context.Context, config *lib.Config, source lib.ReleaseSource, state *lib.State) error {
 	if err := state.SaveMemberState(); err != nil {
 		return err
 	}
@@ -93,16 +102,45 @@ func handleRollout(config *lib.Config, github lib.GitHuber, state *lib.State) er
 		return nil
 	}
 
-	if err := state.CanInstallTag(tag); err != nil {
+	stable, err := state.StableRelease()
+	if err != nil {
 		return err
 	}
-	got, err := state.TryRolloutLock(tag)
+	if stable != nil && stable.Directives != nil && stable.Directives.Skip {
+		return fmt.Errorf("%w: tag:%s", lib.ErrReleaseSkipped, tag)
+	}
+
+	// the canary member keeps the release waiting for the manual promotion instead of the old stable tag
+	pending, err := state.PendingPromotion()
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		installed, err := state.GetLastInstalledTag()
+		if err != nil {
+			return err
+		}
+		if installed == pending.Tag {
+			return fmt.Errorf("%w: tag:%s", lib.ErrWaitingPromotion, pending.Tag)
+		}
+	}
+
+	if err := state.CanInstallTag(tag); err != nil {
+		if !errors.Is(err, lib.ErrAlreadyInstalled) || !installedAssetsReuploaded(config, stable) {
+			return err
+		}
+		slog.Info("assets of the stable tag are re-uploaded, rollout again", "tag", tag)
+	}
+	lease, err := state.TryRolloutLock(tag)
 	if err != nil {
 		return err
 	}
-	if got {
-		slog.Info("lock success and start rollout", "tag", tag)
-		if _, _, err := deploy(config.DeployCommand, tag, state, github); err != nil {
+	if lease != nil {
+		// the next member waits for the rollout window after the deploy
+		lease.KeepAlive()
+		defer lease.Stop()
+		slog.Info("lock success and start rollout", "tag", tag, "token", lease.Token)
+		if _, _, err := deploy(ctx, config.DeployCommand, tag, state, source); err != nil {
 			return errors.Wrap(err, "deploy command failed")
 		}
 
@@ -115,11 +153,13 @@ func handleRollout(config *lib.Config, github lib.GitHuber, state *lib.State) er
 			return err
 		}
 		slog.Info("rollout success", "tag", tag, "progress", fmt.Sprintf("%d/%d", installed, all))
+		deployments.Progress(tag, installed, all)
+		cleanupAssets(config, state, tag)
 	}
 	return nil
 }
 
-func handleCanaryRelease(config *lib.Config, github lib.GitHuber, state *lib.State) error {
+func handleCanaryRelease(ctx context.Context, config *lib.Config, source lib.ReleaseSource, state *lib.State) error {
 	if err := state.SaveMemberState(); err != nil {
 		return err
 	}
@@ -135,81 +175,420 @@ func handleCanaryRelease(config *lib.Config, github lib.GitHuber, state *lib.Sta
 		return err
 	}
 
-	tag, _, err := github.DownloadReleaseAsset(lib.LatestTag)
+	info, err := source.ResolveRelease(ctx, lib.LatestTag)
 	if err != nil {
-		return fmt.Errorf("can't get release asset:%s %s", tag, err)
+		return fmt.Errorf("can't resolve release: %w", err)
 	}
+	tag := info.Tag
 
+	directives := info.Directives
+	if directives == nil {
+		directives = &lib.Directives{}
+	}
+	if directives.Skip {
+		return fmt.Errorf("%w: tag:%s", lib.ErrReleaseSkipped, tag)
+	}
+
+	reupload := false
 	if tag == stableTab {
-		return nil
+		reupload, err = checkReupload(config, state, info)
+		if err != nil || !reupload {
+			return err
+		}
 	}
 
-	err = state.CanInstallTag(tag)
-	if err != nil {
+	err = state.CanInstallRelease(info)
+	if err != nil && !(reupload && errors.Is(err, lib.ErrAlreadyInstalled)) {
 		return err
 	}
 
-	got, err := state.TryCanaryReleaseLock(tag)
+	if config.MinReleaseAge > 0 {
+		if err := state.CheckReleaseSettled(info, config.MinReleaseAge); err != nil {
+			if errors.Is(err, lib.ErrReleaseSettling) {
+				slog.Info("waiting for release to settle", "tag", tag, "published_at", info.PublishedAt, "min_release_age", config.MinReleaseAge)
+			}
+			return err
+		}
+	}
+
+	if directives.RequiresManualPromotion {
+		pending, err := state.PendingPromotion()
+		if err != nil {
+			return err
+		}
+		if pending != nil && pending.Tag == tag {
+			return fmt.Errorf("%w: tag:%s", lib.ErrWaitingPromotion, tag)
+		}
+	}
+
+	window := config.CanaryRolloutWindow
+	if directives.CanaryWindow > 0 {
+		window = directives.CanaryWindow
+	}
+
+	lease, err := state.TryCanaryReleaseLock(tag, window)
 	if err != nil {
 		return err
 	}
 
-	if got {
-		slog.Info("lock success and start canary release", "tag", tag)
-		if tag, filename, err := deploy(config.DeployCommand, tag, state, github); err != nil {
-			return errors.Wrap(err, "deploy command failed")
-		} else {
-			slog.Info("deploy command success and start health check", "tag", tag, "cmd", config.HealthCheckCommand)
-			if out, err := runHealthCheck(config, tag, filename); err != nil {
-				slog.Error("health check command failed", slog.String("err", err.Error()), slog.String("out", out))
-				if err := state.SaveAvoidReleaseTag(tag); err != nil {
-					return fmt.Errorf("can't save avoid tag:%s", err)
-				}
+	if lease != nil {
+		// a slow canary keeps the lock, it expires only when this member dies
+		lease.KeepAlive()
+		defer lease.Stop()
+		if reupload {
+			first, err := state.MarkReuploadDetected(info)
+			if err != nil {
+				return fmt.Errorf("can't mark re-upload:%w", err)
+			}
+			if !first {
+				// another member released the re-upload between the check and the lock
+				return lease.Release()
+			}
+		}
+		slog.Info("lock success and start canary release", "tag", tag, "token", lease.Token)
+		hostname, _ := os.Hostname()
+		deployments.Start(tag, fmt.Sprintf("canary release on %s", hostname))
+
+		// the record tells the restarted member to roll back the half deployed canary
+		canary := &lib.CanaryRecord{
+			Release:     info,
+			PreviousTag: lastInstalledTag,
+			Reupload:    reupload,
+			Window:      window,
+		}
+		if err := state.SaveCanaryPhase(canary, lib.CanaryPhaseDeploying); err != nil {
+			return fmt.Errorf("can't save canary phase:%s", err)
+		}
 
-				// try rollback
-				rollbackTag, err := state.RollbackTag(lastInstalledTag)
-				if err != nil {
-					return err
+		// deploy returns an empty tag on error, the failure is reported for the tag of the canary release
+		_, filename, err := deploy(ctx, config.DeployCommand, tag, state, source)
+		if err != nil {
+			if err := state.ClearCanaryRecord(); err != nil {
+				slog.Warn("can't clear canary phase", "err", err)
+			}
+			if errors.Is(err, lib.ErrChecksumMismatch) || errors.Is(err, lib.ErrSignatureInvalid) {
+				if err := lease.SaveAvoidReleaseTag(tag); err != nil {
+					return fmt.Errorf("can't save avoid tag:%w", err)
 				}
-				return handleRollback(rollbackTag, config, state, github)
-			} else {
-				slog.Info("health check success", "tag", tag)
-				if err := state.SaveStableReleaseTag(tag); err != nil {
-					return fmt.Errorf("can't save stable tag:%s", err)
+				if err := lease.Release(); err != nil {
+					return fmt.Errorf("can't unlock canary release tag")
 				}
-
-				if err := state.SaveMemberState(); err != nil {
-					slog.Error(fmt.Sprintf("failed to save state: %s", err))
+			} else if errors.Is(err, lib.ErrAssetsCannotDownload) || errors.Is(err, lib.ErrRateLimited) || ctx.Err() != nil {
+				// nothing is deployed yet, another member can start the canary release
+				if err := lease.Release(); err != nil {
+					return fmt.Errorf("can't unlock canary release tag")
 				}
+			}
+			deployments.Update(tag, lib.DeploymentFailure, fmt.Sprintf("canary deploy failed: %s", err))
+			return errors.Wrap(err, "deploy command failed")
+		}
 
-				if err := state.UnlockCanaryRelease(); err != nil {
-					return fmt.Errorf("can't unlock canary release tag")
+		canary.File = filename
+		if err := state.SaveCanaryPhase(canary, lib.CanaryPhaseChecking); err != nil {
+			return fmt.Errorf("can't save canary phase:%s", err)
+		}
+		slog.Info("deploy command success and start health check", "tag", tag, "cmd", config.HealthCheckCommand)
+		return checkCanary(ctx, config, source, state, lease, canary, window)
+	}
+	return nil
+}
+
+// checkCanary runs the health check of the deployed canary for the window, then promotes it or rolls it back
+func checkCanary(ctx context.Context, config *lib.Config, source lib.ReleaseSource, state *lib.State, lease *lib.Lease, canary *lib.CanaryRecord, window time.Duration) error {
+	info := canary.Release
+	tag := info.Tag
+	directives := info.Directives
+	if directives == nil {
+		directives = &lib.Directives{}
+	}
+
+	// the release notes aren't signed, the command of the directive is run only when it is allowed explicitly
+	extraCommand := directives.HealthCheckCommand
+	if extraCommand != "" && !config.AllowDirectiveCommands {
+		slog.Warn("healthcheck_command directive is ignored, set allow_directive_commands to run it", "tag", tag)
+		extraCommand = ""
+	}
+
+	if out, err := runHealthCheck(ctx, config, lease, tag, canary.File, window, extraCommand); err != nil {
+		if ctx.Err() != nil {
+			// neither promoted nor avoided, the lease and the record are kept, so that the health check is resumed after restart
+			slog.Warn("canary release is interrupted by shutdown", "tag", tag)
+			deployments.Update(tag, lib.DeploymentError, "canary release is interrupted by shutdown")
+			return ctx.Err()
+		}
+		if errors.Is(err, lib.ErrLeaseLost) {
+			// another member may run the canary release of the tag, it is neither promoted nor avoided by this member
+			slog.Error("lease of canary release is lost during health check", "tag", tag, "err", err)
+			if canary.Reupload {
+				if err := state.ClearCanaryRecord(); err != nil {
+					slog.Warn("can't clear canary phase", "err", err)
 				}
-				slog.Info("canary release success", "tag", tag)
-				return nil
+				return err
+			}
+			return rollbackCanary(ctx, config, source, state, canary, "lease of canary release is lost")
+		}
+		slog.Error("health check command failed", slog.String("err", err.Error()), slog.String("out", out))
+		if canary.Reupload {
+			if err := state.ClearCanaryRecord(); err != nil {
+				slog.Warn("can't clear canary phase", "err", err)
 			}
+			// the previous assets of the tag are replaced and can't be restored
+			deployments.Update(tag, lib.DeploymentError, "re-uploaded assets failed health check and can't be rolled back")
+			return errors.Wrap(ErrRollbackFailed, fmt.Sprintf("re-uploaded assets of tag:%s failed health check", tag))
+		}
+		// the failed canary is rolled back even when the lease is lost, another member retries the tag then
+		if err := lease.SaveAvoidReleaseTag(tag); err != nil {
+			slog.Warn("can't save avoid tag", "tag", tag, "err", err)
+		}
+		return rollbackCanary(ctx, config, source, state, canary, "canary failed health check")
+	}
+
+	slog.Info("health check success", "tag", tag)
+	// a member whose lease expired must not promote the tag, another member may be running the canary release
+	if directives.RequiresManualPromotion {
+		if err := lease.SavePendingPromotion(info); err != nil {
+			return fmt.Errorf("can't save pending promotion:%w", err)
 		}
+	} else if err := lease.SaveStableRelease(info); err != nil {
+		return fmt.Errorf("can't save stable tag:%w", err)
 	}
+	if err := state.ClearCanaryRecord(); err != nil {
+		slog.Warn("can't clear canary phase", "err", err)
+	}
+
+	if err := state.SaveMemberState(); err != nil {
+		slog.Error(fmt.Sprintf("failed to save state: %s", err))
+	}
+
+	if err := lease.Release(); err != nil {
+		return fmt.Errorf("can't unlock canary release tag")
+	}
+	if directives.RequiresManualPromotion {
+		slog.Info("canary release success, waiting for manual promotion", "tag", tag)
+		deployments.Update(tag, lib.DeploymentInProgress, "canary passed health check, waiting for manual promotion")
+	} else {
+		slog.Info("canary release success", "tag", tag)
+		if installed, all, err := state.GetRolloutProgress(tag); err != nil {
+			slog.Warn("can't get rollout progress", "tag", tag, "err", err)
+		} else {
+			deployments.Progress(tag, installed, all)
+		}
+	}
+	cleanupAssets(config, state, tag)
 	return nil
 }
 
+// rollbackCanary rolls back the canary to the version installed before it.
+// The record is cleared on success and moved to rollback-failed when the rollback failed.
+func rollbackCanary(ctx context.Context, config *lib.Config, source lib.ReleaseSource, state *lib.State, canary *lib.CanaryRecord, reason string) error {
+	tag := canary.Release.Tag
+	if err := state.SaveCanaryPhase(canary, lib.CanaryPhaseRollingBack); err != nil {
+		return fmt.Errorf("can't save canary phase:%s", err)
+	}
+
+	rollbackTag, err := state.RollbackTag(canary.PreviousTag)
+	if err != nil {
+		err = errors.Wrap(ErrRollbackFailed, err.Error())
+	} else {
+		err = handleRollback(ctx, rollbackTag, config, state, source)
+	}
+	switch {
+	case errors.Is(err, ErrRollback):
+		deployments.Update(tag, lib.DeploymentFailure, fmt.Sprintf("%s, rolled back to %s", reason, rollbackTag))
+	case errors.Is(err, ErrNoRollback):
+		deployments.Update(tag, lib.DeploymentFailure, reason+", no rollback command")
+	case errors.Is(err, ErrRollbackFailed):
+		deployments.Update(tag, lib.DeploymentError, reason+" and rollback failed")
+		// a failed rollback isn't retried after restart, it would fail again and again
+		if err := state.SaveCanaryPhase(canary, lib.CanaryPhaseRollbackFailed); err != nil {
+			slog.Warn("can't save canary phase", "err", err)
+		}
+		return err
+	default:
+		// interrupted before the rollback command, the rollback is retried after restart
+		deployments.Update(tag, lib.DeploymentError, reason+" and rollback failed")
+		return err
+	}
+	if err := state.ClearCanaryRecord(); err != nil {
+		slog.Warn("can't clear canary phase", "err", err)
+	}
+	return err
+}
+
+// recoverCanary resumes or rolls back the canary release which this member left by a crash or a reboot
+func recoverCanary(ctx context.Context, config *lib.Config, source lib.ReleaseSource, state *lib.State) error {
+	canary, err := state.CanaryRecord()
+	if err != nil || canary == nil {
+		return err
+	}
+	tag := canary.Release.Tag
+	if canary.Phase == lib.CanaryPhaseRollbackFailed {
+		// the server stopped at the failure, it is reported again instead of retrying the rollback
+		slog.Error("CRITICAL: rollback of canary release failed before restart, manual recovery is required", "severity", "critical", "tag", tag, "previous_tag", canary.PreviousTag, "since", canary.Since)
+		deployments.Update(tag, lib.DeploymentError, "rollback of canary release failed before restart, manual recovery is required")
+		return state.ClearCanaryRecord()
+	}
+	slog.Warn("found canary release left by restart", "tag", tag, "phase", canary.Phase, "since", canary.Since)
+
+	installedTag, err := state.GetLastInstalledTag()
+	if err != nil {
+		return err
+	}
+	lease, err := state.ResumeCanaryReleaseLock(tag, canary.Window)
+	if err != nil {
+		return err
+	}
+
+	var result error
+	switch {
+	case canary.Phase == lib.CanaryPhaseChecking && lease != nil && installedTag == tag:
+		lease.KeepAlive()
+		defer lease.Stop()
+		// the health check runs at least once even if the window has passed
+		remaining := max(time.Until(canary.Since.Add(canary.Window)), time.Nanosecond)
+		slog.Info("resume health check of canary release", "tag", tag, "remaining", remaining.Round(time.Second), "token", lease.Token)
+		return checkCanary(ctx, config, source, state, lease, canary, remaining)
+	case installedTag == canary.PreviousTag && canary.PreviousTag != "":
+		// the canary isn't installed yet
+		slog.Info("canary release was not deployed before restart", "tag", tag)
+	case canary.Reupload:
+		if err := state.ClearCanaryRecord(); err != nil {
+			slog.Warn("can't clear canary phase", "err", err)
+		}
+		deployments.Update(tag, lib.DeploymentError, "canary release of re-uploaded assets is interrupted by restart and can't be rolled back")
+		return errors.Wrap(ErrRollbackFailed, fmt.Sprintf("re-uploaded assets of tag:%s are left by restart", tag))
+	default:
+		// the half deployed canary or the canary whose lock is taken over can't be promoted
+		result = rollbackCanary(ctx, config, source, state, canary, "canary release is interrupted by restart")
+		if !errors.Is(result, ErrRollback) && !errors.Is(result, ErrNoRollback) {
+			// the record is kept for the next restart and the lease expires by itself
+			return result
+		}
+	}
+
+	if err := state.ClearCanaryRecord(); err != nil {
+		slog.Warn("can't clear canary phase", "err", err)
+	}
+	if lease != nil {
+		// the canary release of the tag is started again
+		if err := lease.Release(); err != nil {
+			return err
+		}
+	}
+	return result
+}
+
 var ErrRollback = errors.New("rollback")
 var ErrNoRollback = errors.New("no rollback")
+var ErrRollbackFailed = errors.New("rollback failed")
 
-func handleRollback(rollbackTag string, config *lib.Config, state *lib.State, github lib.GitHuber) error {
+func handleRollback(ctx context.Context, rollbackTag string, config *lib.Config, state *lib.State, source lib.ReleaseSource) error {
 	if config.RollbackCommand == "" {
 		return ErrNoRollback
 	}
 	slog.Info("start rollback", "tag", rollbackTag)
-	if _, _, err := deploy(config.RollbackCommand, rollbackTag, state, github); err != nil {
-		return errors.Wrap(err, "rollback command failed")
+
+	// the rollback doesn't depend on the release source when the asset is cached
+	cached, err := lib.NewAssetCache(config.SaveAssetsPath).Lookup(rollbackTag)
+	if err != nil {
+		slog.Warn("can't read asset index", "err", err)
+	}
+	if cached != nil {
+		slog.Info("rollback with cached asset", "tag", rollbackTag, "path", cached.Path)
+		if out, err := executeCommand(config.RollbackCommand, rollbackTag, cached.Path, 5*time.Minute); err != nil {
+			return errors.Wrap(ErrRollbackFailed, fmt.Sprintf("rollback command failed: %s, %s", err, out))
+		}
+	} else if _, _, err := deploy(ctx, config.RollbackCommand, rollbackTag, state, source); err != nil {
+		return errors.Wrap(ErrRollbackFailed, err.Error())
 	}
 	slog.Info("rollback success", "tag", rollbackTag)
+	cleanupAssets(config, state, rollbackTag)
 	return ErrRollback
 
 }
-func runServer(config *lib.Config) error {
-	github, err := lib.NewGitHub(config)
+
+// checkReupload reports whether the re-uploaded assets of the stable tag should be released by canary release
+func checkReupload(config *lib.Config, state *lib.State, info *lib.ReleaseInfo) (bool, error) {
+	stable, err := state.StableRelease()
+	if err != nil {
+		return false, err
+	}
+	// the re-uploads of the assets which this member doesn't deploy are ignored
+	if stable == nil || !info.MatchedAssetsChanged(stable) {
+		return false, nil
+	}
+
+	// the re-upload released by canary release is marked when the canary release starts,
+	// so that it is retried after the canary release is given up before the lock
+	if config.ReuploadPolicy == lib.ReuploadPolicyCanary {
+		detected, err := state.ReuploadDetected(info)
+		if err != nil || detected {
+			return false, err
+		}
+		slog.Warn("assets of the stable tag are re-uploaded, start canary release again", "tag", info.Tag, "asset", info.Asset)
+		return true, nil
+	}
+
+	first, err := state.MarkReuploadDetected(info)
+	if err != nil || !first {
+		return false, err
+	}
+	slog.Error("assets of the stable tag are re-uploaded, members may run divergent assets", "tag", info.Tag, "asset", info.Asset, "asset_id", info.AssetID, "updated_at", info.AssetUpdatedAt)
+	return false, nil
+}
+
+// installedAssetsReuploaded reports whether the assets deployed on this member differ from the stable release
+func installedAssetsReuploaded(config *lib.Config, stable *lib.ReleaseInfo) bool {
+	if config.ReuploadPolicy != lib.ReuploadPolicyCanary || stable == nil {
+		return false
+	}
+
+	cached, err := lib.NewAssetCache(config.SaveAssetsPath).Lookup(stable.Tag)
+	if err != nil {
+		slog.Warn("can't read asset index", "err", err)
+		return false
+	}
+	return cached != nil && cached.Reuploaded(stable)
+}
+
+// cleanupAssets records the deployed tag and prunes the cached assets out of the retention policy
+func cleanupAssets(config *lib.Config, state *lib.State, tag string) {
+	cache := lib.NewAssetCache(config.SaveAssetsPath)
+	if err := cache.MarkDeployed(tag); err != nil {
+		slog.Warn("can't update asset index", "err", err)
+	}
+
+	removed, err := pruneAssets(config, state, cache, false)
+	if err != nil {
+		slog.Warn("can't prune cached assets", "err", err)
+		return
+	}
+	for _, a := range removed {
+		slog.Info("pruned cached asset", "tag", a.Tag, "path", a.Path)
+	}
+}
+
+// pruneAssets never removes the assets of the stable tag and the installed tag
+func pruneAssets(config *lib.Config, state *lib.State, cache *lib.AssetCache, dryRun bool) ([]*lib.CachedAsset, error) {
+	stableTag, err := state.CurrentStableTag()
+	if err != nil {
+		return nil, err
+	}
+
+	installedTag, err := state.GetLastInstalledTag()
+	if err != nil {
+		return nil, err
+	}
+
+	policy := lib.RetentionPolicy{
+		KeepTags: config.CacheKeepTags,
+		MaxBytes: config.CacheMaxBytes,
+	}
+	return cache.Prune(policy, dryRun, stableTag, installedTag)
+}
+
+func runServer(ctx context.Context, config *lib.Config) error {
+	source, err := lib.NewReleaseSource(config)
 	if err != nil {
 		return err
 	}
@@ -230,15 +609,48 @@ func runServer(config *lib.Config) error {
 	if err != nil {
 		return err
 	}
+	defer state.Close()
+
+	if config.LeaderElection {
+		source = lib.NewLeaderSource(config, source, state)
+	}
+
+	deployments, err = lib.NewDeploymentReporter(config, state)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// the reports queued before shutdown are sent within the timeout
+		cctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		deployments.Close(cctx)
+	}()
+
+	// the canary release left by a crash or a reboot is finished before anything else
+	if err := recoverCanary(ctx, config, source, state); err != nil {
+		if stop, err := handleCanaryError(ctx, err); stop {
+			return err
+		}
+	}
 
 	for {
 		select {
+		case <-ctx.Done():
+			slog.Info("shutdown")
+			return nil
 		case <-rolloutTicker.C:
-			if err := handleRollout(config, github, state); err != nil {
-				if errors.Is(err, lib.ErrAlreadyInstalled) {
+			if err := handleRollout(ctx, config, source, state); err != nil {
+				if ctx.Err() != nil {
+					slog.Info("shutdown", "err", err)
+					return nil
+				} else if errors.Is(err, lib.ErrAlreadyInstalled) || errors.Is(err, lib.ErrReleaseSkipped) || errors.Is(err, lib.ErrWaitingPromotion) {
 					slog.Debug("can't rollout", "err", err)
 				} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
 					slog.Warn("can't get assets files")
+				} else if errors.Is(err, lib.ErrRateLimited) {
+					slog.Warn("api rate limited, skip until reset", "err", err)
+				} else if errors.Is(err, lib.ErrChecksumMismatch) || errors.Is(err, lib.ErrSignatureInvalid) {
+					slog.Warn("asset verification failed", "err", err)
 				} else {
 					return err
 				}
@@ -247,23 +659,10 @@ func runServer(config *lib.Config) error {
 				rolloutTicker.Stop()
 			}
 		case <-gitTicker.C:
-			if err := handleCanaryRelease(config, github, state); err != nil {
-				if errors.Is(err, lib.ErrAssetsNotFound) ||
-					errors.Is(err, lib.ErrAlreadyInstalled) ||
-					errors.Is(err, lib.ErrAvoidReleaseTag) {
-					slog.Debug("can't rollout", "err", err)
-				} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
-					slog.Warn("can't get assets files")
-				} else {
-					if errors.Is(err, ErrRollback) {
-						slog.Warn("rollback success")
-					} else if errors.Is(err, ErrNoRollback) {
-						slog.Info("no rollback because no rollback command")
-					} else {
-						return err
-					}
+			if err := handleCanaryRelease(ctx, config, source, state); err != nil {
+				if stop, err := handleCanaryError(ctx, err); stop {
+					return err
 				}
-
 			}
 			if viper.GetBool("once") {
 				return nil
@@ -272,9 +671,45 @@ func runServer(config *lib.Config) error {
 	}
 }
 
-func runHealthCheck(config *lib.Config, tag, file string) (string, error) {
+// handleCanaryError logs the error of the canary release and reports whether the server stops
+func handleCanaryError(ctx context.Context, err error) (bool, error) {
+	if ctx.Err() != nil && !errors.Is(err, ErrRollbackFailed) {
+		slog.Info("shutdown", "err", err)
+		return true, nil
+	} else if errors.Is(err, lib.ErrAssetsNotFound) ||
+		errors.Is(err, lib.ErrAlreadyInstalled) ||
+		errors.Is(err, lib.ErrAvoidReleaseTag) ||
+		errors.Is(err, lib.ErrReleaseSkipped) ||
+		errors.Is(err, lib.ErrWaitingPromotion) ||
+		errors.Is(err, lib.ErrReleaseSettling) {
+		slog.Debug("can't rollout", "err", err)
+	} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
+		slog.Warn("can't get assets files")
+	} else if errors.Is(err, lib.ErrRateLimited) {
+		slog.Warn("api rate limited, skip until reset", "err", err)
+	} else if errors.Is(err, lib.ErrChecksumMismatch) || errors.Is(err, lib.ErrSignatureInvalid) {
+		slog.Warn("asset verification failed, avoid this tag", "err", err)
+	} else if errors.Is(err, lib.ErrDowngrade) {
+		slog.Warn("refuse to downgrade", "err", err)
+	} else if errors.Is(err, lib.ErrLeaseLost) {
+		slog.Warn("canary release lock is lost, leave the tag to the new holder", "err", err)
+	} else if errors.Is(err, ErrRollback) {
+		slog.Warn("rollback success")
+	} else if errors.Is(err, ErrNoRollback) {
+		slog.Info("no rollback because no rollback command")
+	} else if errors.Is(err, ErrRollbackFailed) {
+		slog.Error("CRITICAL: rollback failed, manual recovery is required", "severity", "critical", "err", err)
+		return true, err
+	} else {
+		return true, err
+	}
+	return false, nil
+}
+
+// runHealthCheck runs the health check for the window, it is aborted with ErrLeaseLost when the lease of the canary release is lost
+func runHealthCheck(ctx context.Context, config *lib.Config, lease *lib.Lease, tag, file string, window time.Duration, extraCommand string) (string, error) {
 	healthCheckTick := time.NewTicker(config.HealthCheckInterval)
-	canaryReleaseTick := time.NewTicker(config.CanaryRolloutWindow)
+	canaryReleaseTick := time.NewTicker(window)
 
 	if viper.GetBool("once") {
 		healthCheckTick = time.NewTicker(time.Nanosecond)
@@ -285,7 +720,7 @@ func runHealthCheck(config *lib.Config, tag, file string) (string, error) {
 	f := func() (string, error) {
 		ret := ""
 		cxt, cancel := context.WithTimeout(
-			context.Background(),
+			ctx,
 			config.HealthCheckTimeout*time.Duration(config.HealthCheckRetries)+
 				config.HealthCheckInterval*time.Duration(config.HealthCheckRetries))
 		defer cancel()
@@ -296,6 +731,15 @@ func runHealthCheck(config *lib.Config, tag, file string) (string, error) {
 				if err != nil {
 					return fmt.Errorf("health check command failed: %s, %s", err.Error(), string(out))
 				}
+
+				// the extra health check command specified by the release directive
+				if extraCommand != "" {
+					out, err := executeCommand(extraCommand, tag, file, config.HealthCheckTimeout)
+					ret = string(out)
+					if err != nil {
+						return fmt.Errorf("health check command of release directive failed: %s, %s", err.Error(), string(out))
+					}
+				}
 				return nil
 			},
 			retry.Context(cxt),
@@ -317,6 +761,12 @@ func runHealthCheck(config *lib.Config, tag, file string) (string, error) {
 
 		case <-canaryReleaseTick.C:
 			return "", nil
+
+		case <-lease.Lost():
+			return "", lease.Check()
+
+		case <-ctx.Done():
+			return "", ctx.Err()
 		}
 	}
 }
@@ -332,6 +782,7 @@ func executeCommand(command string, tag, file string, timeout time.Duration) ([]
 	cmd := exec.CommandContext(ctx, "sh", "-c", command)
 	cmd.Env = append(os.Environ(), fmt.Sprintf("RELEASE_TAG=%s", tag))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("ASSET_FILE=%s", file))
+	cmd.Env = append(cmd.Env, lib.AssetEnv(tag, file)...)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -440,12 +891,60 @@ func init() {
 	rootCmd.PersistentFlags().String("repo", "", "GitHub repository name")
 	viper.BindPFlag("repo", rootCmd.PersistentFlags().Lookup("repo"))
 
+	rootCmd.PersistentFlags().String("source", lib.SourceGitHub, "release source(github, gitlab or mirror)")
+	viper.BindPFlag("source", rootCmd.PersistentFlags().Lookup("source"))
+
 	rootCmd.PersistentFlags().String("github-token", "", "GitHub token")
 	viper.BindPFlag("github_token", rootCmd.PersistentFlags().Lookup("github-token"))
 
-	rootCmd.PersistentFlags().String("github-api", "https://api.github.com", "GitHub API endpoint")
+	rootCmd.PersistentFlags().String("github-api", "", "GitHub API endpoint(default https://api.github.com or GITHUB_API_URL)")
 	viper.BindPFlag("github_api", rootCmd.PersistentFlags().Lookup("github-api"))
 
+	rootCmd.PersistentFlags().String("github-upload-url", "", "GitHub upload URL(default derived from github-api)")
+	viper.BindPFlag("github_upload_url", rootCmd.PersistentFlags().Lookup("github-upload-url"))
+
+	rootCmd.PersistentFlags().Int64("github-app-id", 0, "GitHub App ID")
+	viper.BindPFlag("github_app_id", rootCmd.PersistentFlags().Lookup("github-app-id"))
+
+	rootCmd.PersistentFlags().Int64("github-app-installation-id", 0, "GitHub App installation ID(default detected from repo)")
+	viper.BindPFlag("github_app_installation_id", rootCmd.PersistentFlags().Lookup("github-app-installation-id"))
+
+	rootCmd.PersistentFlags().String("github-app-private-key-path", "", "GitHub App private key path")
+	viper.BindPFlag("github_app_private_key_path", rootCmd.PersistentFlags().Lookup("github-app-private-key-path"))
+
+	rootCmd.PersistentFlags().String("gitlab-token", "", "GitLab token")
+	viper.BindPFlag("gitlab_token", rootCmd.PersistentFlags().Lookup("gitlab-token"))
+
+	rootCmd.PersistentFlags().String("gitlab-api", "https://gitlab.com/api/v4", "GitLab API endpoint")
+	viper.BindPFlag("gitlab_api", rootCmd.PersistentFlags().Lookup("gitlab-api"))
+
+	rootCmd.PersistentFlags().String("mirror-url", "", "release directory or HTTP index URL of the mirror")
+	viper.BindPFlag("mirror_url", rootCmd.PersistentFlags().Lookup("mirror-url"))
+
+	rootCmd.PersistentFlags().Duration("request-timeout", 30*time.Second, "timeout of each request to the release source")
+	viper.BindPFlag("request_timeout", rootCmd.PersistentFlags().Lookup("request-timeout"))
+
+	rootCmd.PersistentFlags().Duration("download-timeout", 30*time.Minute, "total timeout of downloading an asset including retries")
+	viper.BindPFlag("download_timeout", rootCmd.PersistentFlags().Lookup("download-timeout"))
+
+	rootCmd.PersistentFlags().Uint("request-retries", 3, "retry count of the transient errors(5xx and connection errors) of the release source")
+	viper.BindPFlag("request_retries", rootCmd.PersistentFlags().Lookup("request-retries"))
+
+	rootCmd.PersistentFlags().String("tls-ca-cert", "", "CA certificate file to verify the release source")
+	viper.BindPFlag("tls_ca_cert", rootCmd.PersistentFlags().Lookup("tls-ca-cert"))
+
+	rootCmd.PersistentFlags().String("tls-client-cert", "", "client certificate file for mTLS to the release source")
+	viper.BindPFlag("tls_client_cert", rootCmd.PersistentFlags().Lookup("tls-client-cert"))
+
+	rootCmd.PersistentFlags().String("tls-client-key", "", "client key file for mTLS to the release source")
+	viper.BindPFlag("tls_client_key", rootCmd.PersistentFlags().Lookup("tls-client-key"))
+
+	rootCmd.PersistentFlags().String("http-proxy", "", "HTTP proxy URL to the release source(default HTTPS_PROXY)")
+	viper.BindPFlag("http_proxy", rootCmd.PersistentFlags().Lookup("http-proxy"))
+
+	rootCmd.PersistentFlags().String("no-proxy", "", "comma separated hosts which are not proxied by http-proxy")
+	viper.BindPFlag("no_proxy", rootCmd.PersistentFlags().Lookup("no-proxy"))
+
 	rootCmd.PersistentFlags().String("deploy-command", "", "Deploy command")
 	viper.BindPFlag("deploy_command", rootCmd.PersistentFlags().Lookup("deploy-command"))
 
@@ -479,9 +978,75 @@ func init() {
 	rootCmd.PersistentFlags().String("redis-key-prefix", "", "Redis key prefix(default repo name)")
 	viper.BindPFlag("redis.key_prefix", rootCmd.PersistentFlags().Lookup("redis-key-prefix"))
 
-	rootCmd.PersistentFlags().String("package-name-pattern", "", "Package name pattern")
+	rootCmd.PersistentFlags().StringSlice("redis-addrs", nil, "Redis sentinel or cluster addresses(default redis-host:redis-port)")
+	viper.BindPFlag("redis.addrs", rootCmd.PersistentFlags().Lookup("redis-addrs"))
+
+	rootCmd.PersistentFlags().String("redis-master-name", "", "Redis sentinel master name")
+	viper.BindPFlag("redis.master_name", rootCmd.PersistentFlags().Lookup("redis-master-name"))
+
+	rootCmd.PersistentFlags().String("redis-sentinel-password", "", "Redis sentinel password")
+	viper.BindPFlag("redis.sentinel_password", rootCmd.PersistentFlags().Lookup("redis-sentinel-password"))
+
+	rootCmd.PersistentFlags().Bool("redis-cluster", false, "connect to Redis cluster")
+	viper.BindPFlag("redis.cluster", rootCmd.PersistentFlags().Lookup("redis-cluster"))
+
+	rootCmd.PersistentFlags().String("redis-username", "", "Redis ACL username")
+	viper.BindPFlag("redis.username", rootCmd.PersistentFlags().Lookup("redis-username"))
+
+	rootCmd.PersistentFlags().Bool("redis-tls", false, "connect to Redis over TLS")
+	viper.BindPFlag("redis.tls", rootCmd.PersistentFlags().Lookup("redis-tls"))
+
+	rootCmd.PersistentFlags().String("redis-tls-ca-cert", "", "CA certificate file to verify Redis")
+	viper.BindPFlag("redis.tls_ca_cert", rootCmd.PersistentFlags().Lookup("redis-tls-ca-cert"))
+
+	rootCmd.PersistentFlags().String("redis-tls-client-cert", "", "client certificate file for mTLS to Redis")
+	viper.BindPFlag("redis.tls_client_cert", rootCmd.PersistentFlags().Lookup("redis-tls-client-cert"))
+
+	rootCmd.PersistentFlags().String("redis-tls-client-key", "", "client key file for mTLS to Redis")
+	viper.BindPFlag("redis.tls_client_key", rootCmd.PersistentFlags().Lookup("redis-tls-client-key"))
+
+	rootCmd.PersistentFlags().String("redis-tls-server-name", "", "server name to verify the Redis certificate")
+	viper.BindPFlag("redis.tls_server_name", rootCmd.PersistentFlags().Lookup("redis-tls-server-name"))
+
+	rootCmd.PersistentFlags().String("state-backend", lib.StateBackendRedis, "backend of the shared state(redis, etcd, consul or file)")
+	viper.BindPFlag("state_backend", rootCmd.PersistentFlags().Lookup("state-backend"))
+
+	rootCmd.PersistentFlags().StringSlice("etcd-endpoints", nil, "etcd endpoints")
+	viper.BindPFlag("etcd.endpoints", rootCmd.PersistentFlags().Lookup("etcd-endpoints"))
+
+	rootCmd.PersistentFlags().String("etcd-username", "", "etcd username")
+	viper.BindPFlag("etcd.username", rootCmd.PersistentFlags().Lookup("etcd-username"))
+
+	rootCmd.PersistentFlags().String("etcd-password", "", "etcd password")
+	viper.BindPFlag("etcd.password", rootCmd.PersistentFlags().Lookup("etcd-password"))
+
+	rootCmd.PersistentFlags().String("etcd-key-prefix", "", "etcd key prefix(default repo name)")
+	viper.BindPFlag("etcd.key_prefix", rootCmd.PersistentFlags().Lookup("etcd-key-prefix"))
+
+	rootCmd.PersistentFlags().String("consul-address", "", "Consul agent address(default CONSUL_HTTP_ADDR or 127.0.0.1:8500)")
+	viper.BindPFlag("consul.address", rootCmd.PersistentFlags().Lookup("consul-address"))
+
+	rootCmd.PersistentFlags().String("consul-token", "", "Consul ACL token")
+	viper.BindPFlag("consul.token", rootCmd.PersistentFlags().Lookup("consul-token"))
+
+	rootCmd.PersistentFlags().String("consul-datacenter", "", "Consul datacenter")
+	viper.BindPFlag("consul.datacenter", rootCmd.PersistentFlags().Lookup("consul-datacenter"))
+
+	rootCmd.PersistentFlags().String("consul-key-prefix", "", "Consul key prefix(default repo name)")
+	viper.BindPFlag("consul.key_prefix", rootCmd.PersistentFlags().Lookup("consul-key-prefix"))
+
+	rootCmd.PersistentFlags().String("file-state-dir", "/var/lib/gacr", "directory of the state file(file state backend)")
+	viper.BindPFlag("file_state.dir", rootCmd.PersistentFlags().Lookup("file-state-dir"))
+
+	rootCmd.PersistentFlags().String("file-state-key-prefix", "", "file state key prefix(default repo name)")
+	viper.BindPFlag("file_state.key_prefix", rootCmd.PersistentFlags().Lookup("file-state-key-prefix"))
+
+	rootCmd.PersistentFlags().String("package-name-pattern", "", "Package name pattern(Go template with {{.OS}}, {{.Arch}}, {{.DistroCodename}}, {{.Labels.<key>}} and so on)")
 	viper.BindPFlag("package_name_pattern", rootCmd.PersistentFlags().Lookup("package-name-pattern"))
 
+	rootCmd.PersistentFlags().StringToString("host-label", nil, "host labels used in the package name pattern(e.g. role=web)")
+	viper.BindPFlag("host_labels", rootCmd.PersistentFlags().Lookup("host-label"))
+
 	rootCmd.PersistentFlags().String("log-level", "info", "Log level")
 	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log-level"))
 
@@ -511,4 +1076,49 @@ func init() {
 
 	rootCmd.PersistentFlags().Bool("include-prerelease", false, "include prerelease")
 	viper.BindPFlag("include_prerelease", rootCmd.PersistentFlags().Lookup("include-prerelease"))
+
+	rootCmd.PersistentFlags().String("checksum-pattern", `(?i)(^sha256sums(\.txt)?$|checksums\.txt$)`, "checksums asset name pattern(empty to disable verification)")
+	viper.BindPFlag("checksum_pattern", rootCmd.PersistentFlags().Lookup("checksum-pattern"))
+
+	rootCmd.PersistentFlags().String("signature-keyring", "", "public keys(minisign or OpenPGP) to verify asset signatures")
+	viper.BindPFlag("signature_keyring", rootCmd.PersistentFlags().Lookup("signature-keyring"))
+
+	rootCmd.PersistentFlags().String("release-selection", lib.ReleaseSelectionLatest, "release selection policy(latest or semver)")
+	viper.BindPFlag("release_selection", rootCmd.PersistentFlags().Lookup("release-selection"))
+
+	rootCmd.PersistentFlags().String("version-constraint", "", "semver constraint of release tags(e.g. \">=2.3.0, <3.0.0\", \"~1.4\")")
+	viper.BindPFlag("version_constraint", rootCmd.PersistentFlags().Lookup("version-constraint"))
+
+	rootCmd.PersistentFlags().String("tag-include-pattern", "", "release tag pattern to include")
+	viper.BindPFlag("tag_include_pattern", rootCmd.PersistentFlags().Lookup("tag-include-pattern"))
+
+	rootCmd.PersistentFlags().String("tag-exclude-pattern", "", "release tag pattern to exclude")
+	viper.BindPFlag("tag_exclude_pattern", rootCmd.PersistentFlags().Lookup("tag-exclude-pattern"))
+
+	rootCmd.PersistentFlags().String("allow-downgrade-to", "", "tag which is allowed to canary release even if it is older than the stable tag")
+	viper.BindPFlag("allow_downgrade_to", rootCmd.PersistentFlags().Lookup("allow-downgrade-to"))
+
+	rootCmd.PersistentFlags().Bool("allow-directive-commands", false, "run the healthcheck_command directive of the release notes")
+	viper.BindPFlag("allow_directive_commands", rootCmd.PersistentFlags().Lookup("allow-directive-commands"))
+
+	rootCmd.PersistentFlags().Bool("leader-election", false, "poll the release source only on the leader and share the release through redis")
+	viper.BindPFlag("leader_election", rootCmd.PersistentFlags().Lookup("leader-election"))
+
+	rootCmd.PersistentFlags().Duration("leader-lease", 0, "lease of the polling leader(default 3x repository polling interval)")
+	viper.BindPFlag("leader_lease", rootCmd.PersistentFlags().Lookup("leader-lease"))
+
+	rootCmd.PersistentFlags().Duration("min-release-age", 0, "minimum age of a release before it is eligible for canary release")
+	viper.BindPFlag("min_release_age", rootCmd.PersistentFlags().Lookup("min-release-age"))
+
+	rootCmd.PersistentFlags().String("deployment-environment", "", "report the releases to the GitHub deployment environment")
+	viper.BindPFlag("deployment_environment", rootCmd.PersistentFlags().Lookup("deployment-environment"))
+
+	rootCmd.PersistentFlags().String("reupload-policy", lib.ReuploadPolicyAlert, "action when the assets of the stable tag are re-uploaded(alert or canary)")
+	viper.BindPFlag("reupload_policy", rootCmd.PersistentFlags().Lookup("reupload-policy"))
+
+	rootCmd.PersistentFlags().Int("cache-keep-tags", 5, "number of the recently downloaded tags kept in the save assets path(0 is unlimited)")
+	viper.BindPFlag("cache_keep_tags", rootCmd.PersistentFlags().Lookup("cache-keep-tags"))
+
+	rootCmd.PersistentFlags().Int64("cache-max-bytes", 0, "max total bytes of the assets kept in the save assets path(0 is unlimited)")
+	viper.BindPFlag("cache_max_bytes", rootCmd.PersistentFlags().Lookup("cache-max-bytes"))
 }
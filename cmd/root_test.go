@@ -3,7 +3,9 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -15,13 +17,20 @@ import (
 	"go.uber.org/mock/gomock"
 )
 
-// MockGitHuber is a mock type for the GitHuber interface
-type MockGitHuber struct {
+// MockReleaseSource is a mock type for the ReleaseSource interface
+type MockReleaseSource struct {
 	mock.Mock
 }
 
+// ResolveRelease mocks the ResolveRelease method
+func (m *MockReleaseSource) ResolveRelease(ctx context.Context, tag string) (*lib.ReleaseInfo, error) {
+	args := m.Called(tag)
+	info, _ := args.Get(0).(*lib.ReleaseInfo)
+	return info, args.Error(1)
+}
+
 // DownloadReleaseAsset mocks the DownloadReleaseAsset method
-func (m *MockGitHuber) DownloadReleaseAsset(tag string) (string, string, error) {
+func (m *MockReleaseSource) DownloadReleaseAsset(ctx context.Context, tag string) (string, string, error) {
 	args := m.Called(tag)
 	return args.String(0), args.String(1), args.Error(2)
 }
@@ -31,7 +40,7 @@ func TestDeploy(t *testing.T) {
 		name      string
 		cmd       string
 		tag       string
-		mockSetup func(*MockGitHuber)
+		mockSetup func(*MockReleaseSource)
 		wantTag   string
 		wantFile  string
 		wantErr   bool
@@ -40,7 +49,7 @@ func TestDeploy(t *testing.T) {
 			name: "Successful deployment",
 			cmd:  "../testdata/dummy.sh",
 			tag:  "latest",
-			mockSetup: func(m *MockGitHuber) {
+			mockSetup: func(m *MockReleaseSource) {
 				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
 			},
 			wantTag:  "latest",
@@ -51,7 +60,7 @@ func TestDeploy(t *testing.T) {
 			name: "Failed to download asset",
 			cmd:  "echo",
 			tag:  "v1.0.0",
-			mockSetup: func(m *MockGitHuber) {
+			mockSetup: func(m *MockReleaseSource) {
 				m.On("DownloadReleaseAsset", "v1.0.0").Return("", "", errors.New("download error"))
 			},
 			wantErr: true,
@@ -60,8 +69,8 @@ func TestDeploy(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockGitHub := new(MockGitHuber)
-			tt.mockSetup(mockGitHub)
+			mockSource := new(MockReleaseSource)
+			tt.mockSetup(mockSource)
 			redisHost := os.Getenv("GACR_REDIS_HOST")
 			if redisHost == "" {
 				redisHost = "localhost"
@@ -80,7 +89,7 @@ func TestDeploy(t *testing.T) {
 			state, err := lib.NewState(config)
 			assert.NoError(t, err)
 
-			tag, file, err := deploy(tt.cmd, tt.tag, state, mockGitHub)
+			tag, file, err := deploy(context.Background(), tt.cmd, tt.tag, state, mockSource)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -90,7 +99,7 @@ func TestDeploy(t *testing.T) {
 				assert.Equal(t, tt.wantFile, file)
 			}
 
-			mockGitHub.AssertExpectations(t)
+			mockSource.AssertExpectations(t)
 		})
 	}
 }
@@ -102,14 +111,14 @@ func TestHandleRollout(t *testing.T) {
 	redisClient := testutils.RedisClient()
 	testCases := []struct {
 		name          string
-		mockSetup     func(*MockGitHuber)
+		mockSetup     func(*MockReleaseSource)
 		expectedError bool
 		wantError     error
 		before        func(redisClient *redis.Client)
 	}{
 		{
 			name: "Successful Rollout",
-			mockSetup: func(m *MockGitHuber) {
+			mockSetup: func(m *MockReleaseSource) {
 				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
 			},
 			expectedError: false,
@@ -121,7 +130,7 @@ func TestHandleRollout(t *testing.T) {
 		},
 		{
 			name: "Already installed",
-			mockSetup: func(m *MockGitHuber) {
+			mockSetup: func(m *MockReleaseSource) {
 				m.On("DownloadReleaseAsset", "already_installed").Return("latest", "assetfile", nil)
 			},
 			expectedError: true,
@@ -152,15 +161,15 @@ func TestHandleRollout(t *testing.T) {
 
 			state, err := lib.NewState(config)
 			assert.NoError(t, err)
-			mockGitHub := new(MockGitHuber)
-			tc.mockSetup(mockGitHub)
+			mockSource := new(MockReleaseSource)
+			tc.mockSetup(mockSource)
 			if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
 				t.Fatal(err)
 			}
 
 			tc.before(redisClient)
 
-			err = handleRollout(config, mockGitHub, state)
+			err = handleRollout(context.Background(), config, mockSource, state)
 			if tc.expectedError {
 				assert.Error(t, err)
 				if tc.wantError != nil {
@@ -180,16 +189,18 @@ func TestHandleCanaryRollout(t *testing.T) {
 	redisClient := testutils.RedisClient()
 	testCases := []struct {
 		name               string
-		mockSetup          func(*MockGitHuber)
+		mockSetup          func(*MockReleaseSource)
 		expectedError      bool
 		wantError          error
 		healthCheckCommand string
 		rollbackCommand    string
 		before             func(redisClient *redis.Client)
+		after              func(t *testing.T, redisClient *redis.Client)
 	}{
 		{
 			name: "Successful Rollout",
-			mockSetup: func(m *MockGitHuber) {
+			mockSetup: func(m *MockReleaseSource) {
+				m.On("ResolveRelease", "latest").Return(&lib.ReleaseInfo{Tag: "latest"}, nil)
 				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
 			},
 			expectedError: false,
@@ -201,8 +212,8 @@ func TestHandleCanaryRollout(t *testing.T) {
 		},
 		{
 			name: "Already installed",
-			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+			mockSetup: func(m *MockReleaseSource) {
+				m.On("ResolveRelease", "latest").Return(&lib.ReleaseInfo{Tag: "latest"}, nil)
 			},
 			expectedError: true,
 			before: func(redisClient *redis.Client) {
@@ -214,7 +225,8 @@ func TestHandleCanaryRollout(t *testing.T) {
 		},
 		{
 			name: "Rollback",
-			mockSetup: func(m *MockGitHuber) {
+			mockSetup: func(m *MockReleaseSource) {
+				m.On("ResolveRelease", "latest").Return(&lib.ReleaseInfo{Tag: "latest"}, nil)
 				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
 				m.On("DownloadReleaseAsset", "rollback").Return("stable", "assetfile", nil)
 			},
@@ -227,6 +239,27 @@ func TestHandleCanaryRollout(t *testing.T) {
 			rollbackCommand:    "../testdata/always_succes.sh",
 			wantError:          ErrRollback,
 		},
+		{
+			name: "Checksum mismatch",
+			mockSetup: func(m *MockReleaseSource) {
+				m.On("ResolveRelease", "latest").Return(&lib.ReleaseInfo{Tag: "latest"}, nil)
+				m.On("DownloadReleaseAsset", "latest").Return("latest", "", lib.ErrChecksumMismatch)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "stable")
+			},
+			wantError: lib.ErrChecksumMismatch,
+			after: func(t *testing.T, redisClient *redis.Client) {
+				avoid, err := redisClient.SIsMember(context.Background(), "foo/bar_avoid_release_tag", "latest").Result()
+				assert.NoError(t, err)
+				assert.True(t, avoid)
+
+				_, err = redisClient.Get(context.Background(), "foo/bar_canary_release_tag").Result()
+				assert.Error(t, err)
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -263,14 +296,14 @@ func TestHandleCanaryRollout(t *testing.T) {
 
 			state, err := lib.NewState(config)
 			assert.NoError(t, err)
-			mockGitHub := new(MockGitHuber)
-			tc.mockSetup(mockGitHub)
+			mockSource := new(MockReleaseSource)
+			tc.mockSetup(mockSource)
 			if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
 				t.Fatal(err)
 			}
 			tc.before(redisClient)
 
-			err = handleCanaryRelease(config, mockGitHub, state)
+			err = handleCanaryRelease(context.Background(), config, mockSource, state)
 			if tc.expectedError {
 				assert.Error(t, err)
 				if tc.wantError != nil {
@@ -286,7 +319,745 @@ func TestHandleCanaryRollout(t *testing.T) {
 				_, err = redisClient.Get(context.Background(), "foo/bar_canary_release_tag").Result()
 				assert.Error(t, err)
 			}
+			if tc.after != nil {
+				tc.after(t, redisClient)
+			}
+
+		})
+	}
+}
+
+func TestCanaryReleaseWithMirror(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	root := t.TempDir()
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, tag), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(root, tag, "app_"+tag+".deb"), []byte(tag), 0644))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "v1.0.0", "release.json"), []byte(`{"published_at":"2024-01-01T00:00:00Z"}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "v1.1.0", "release.json"), []byte(`{"published_at":"2024-02-01T00:00:00Z"}`), 0644))
+
+	testCases := []struct {
+		name               string
+		healthCheckCommand string
+		wantError          error
+		wantStableTag      string
+		wantAvoid          bool
+	}{
+		{
+			name:               "canary and rollout",
+			healthCheckCommand: "../testdata/always_succes.sh",
+			wantStableTag:      "v1.1.0",
+		},
+		{
+			name:               "rollback",
+			healthCheckCommand: "../testdata/always_fail.sh",
+			wantError:          ErrRollback,
+			wantAvoid:          true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redisHost := os.Getenv("GACR_REDIS_HOST")
+			if redisHost == "" {
+				redisHost = "localhost"
+			}
+			config := &lib.Config{
+				Source:              lib.SourceMirror,
+				MirrorURL:           root,
+				Repo:                "foo/bar",
+				SaveAssetsPath:      t.TempDir(),
+				PackageNamePattern:  `\.deb$`,
+				Redis:               &lib.RedisConfig{Host: redisHost, Port: 6379},
+				DeployCommand:       "../testdata/always_succes.sh",
+				RollbackCommand:     "../testdata/always_succes.sh",
+				VersionCommand:      "../testdata/echo_version.sh",
+				HealthCheckCommand:  tc.healthCheckCommand,
+				HealthCheckInterval: time.Nanosecond,
+				HealthCheckTimeout:  time.Second,
+				HealthCheckRetries:  1,
+				CanaryRolloutWindow: time.Nanosecond,
+				RolloutWindow:       time.Second,
+			}
+			if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
+				t.Fatal(err)
+			}
+			os.Setenv("TEST_VERSION", "v1.0.0")
+
+			source, err := lib.NewReleaseSource(config)
+			assert.NoError(t, err)
+			state, err := lib.NewState(config)
+			assert.NoError(t, err)
+
+			err = handleCanaryRelease(context.Background(), config, source, state)
+			if tc.wantError != nil {
+				assert.True(t, errors.Is(err, tc.wantError))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			stableTag, err := state.CurrentStableTag()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantStableTag, stableTag)
+
+			avoid, err := redisClient.SIsMember(context.Background(), "foo/bar_avoid_release_tag", "v1.1.0").Result()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantAvoid, avoid)
+
+			if tc.wantStableTag != "" {
+				assert.NoError(t, handleRollout(context.Background(), config, source, state))
+			}
+		})
+	}
+}
+
+func TestHandleRollbackWithCachedAsset(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "v1.0.0"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "v1.0.0", "app_v1.0.0.deb"), []byte("v1.0.0"), 0644))
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Source:             lib.SourceMirror,
+		MirrorURL:          root,
+		Repo:               "foo/bar",
+		SaveAssetsPath:     t.TempDir(),
+		PackageNamePattern: `\.deb$`,
+		Redis:              &lib.RedisConfig{Host: redisHost, Port: 6379},
+		RollbackCommand:    "../testdata/always_succes.sh",
+		VersionCommand:     "../testdata/echo_version.sh",
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	// cache the asset of the rollback target
+	mirror, err := lib.NewReleaseSource(config)
+	assert.NoError(t, err)
+	_, _, err = mirror.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+
+	// the release source is not called
+	mockSource := new(MockReleaseSource)
+	err = handleRollback(context.Background(), "v1.0.0", config, state, mockSource)
+	assert.True(t, errors.Is(err, ErrRollback))
+	mockSource.AssertExpectations(t)
+
+	mockSource = new(MockReleaseSource)
+	mockSource.On("DownloadReleaseAsset", "v0.9.0").Return("", "", lib.ErrAssetsCannotDownload)
+	err = handleRollback(context.Background(), "v0.9.0", config, state, mockSource)
+	assert.True(t, errors.Is(err, ErrRollbackFailed))
+	mockSource.AssertExpectations(t)
+}
+
+func TestCanaryReleaseWithDirectives(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo:                "foo/bar",
+		Redis:               &lib.RedisConfig{Host: redisHost, Port: 6379},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/dummy.sh",
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Hour,
+		RolloutWindow:       time.Second,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	t.Run("skip", func(t *testing.T) {
+		assert.NoError(t, redisClient.FlushAll(context.Background()).Err())
+		os.Setenv("TEST_VERSION", "stable")
+		mockSource := new(MockReleaseSource)
+		mockSource.On("ResolveRelease", "latest").Return(&lib.ReleaseInfo{Tag: "latest", Directives: &lib.Directives{Skip: true}}, nil)
+
+		err := handleCanaryRelease(context.Background(), config, mockSource, state)
+		assert.True(t, errors.Is(err, lib.ErrReleaseSkipped))
+		mockSource.AssertExpectations(t)
+	})
+
+	t.Run("manual promotion", func(t *testing.T) {
+		assert.NoError(t, redisClient.FlushAll(context.Background()).Err())
+		redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+		info := &lib.ReleaseInfo{Tag: "latest", Directives: &lib.Directives{
+			RequiresManualPromotion: true,
+			// the canary window of the config(1h) is overridden
+			CanaryWindow:       time.Nanosecond,
+			HealthCheckCommand: "../testdata/always_succes.sh",
+		}}
+		mockSource := new(MockReleaseSource)
+		mockSource.On("ResolveRelease", "latest").Return(info, nil)
+		mockSource.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+
+		os.Setenv("TEST_VERSION", "stable")
+		assert.NoError(t, handleCanaryRelease(context.Background(), config, mockSource, state))
+
+		stableTag, err := state.CurrentStableTag()
+		assert.NoError(t, err)
+		assert.Equal(t, "stable", stableTag)
+
+		// the other members wait for the promotion
+		err = handleCanaryRelease(context.Background(), config, mockSource, state)
+		assert.True(t, errors.Is(err, lib.ErrWaitingPromotion))
+
+		// the canary member doesn't roll out the old stable tag
+		os.Setenv("TEST_VERSION", "latest")
+		err = handleRollout(context.Background(), config, mockSource, state)
+		assert.True(t, errors.Is(err, lib.ErrWaitingPromotion))
+
+		_, err = state.Promote("other")
+		assert.Error(t, err)
+		_, err = state.Promote("latest")
+		assert.NoError(t, err)
+
+		stableTag, err = state.CurrentStableTag()
+		assert.NoError(t, err)
+		assert.Equal(t, "latest", stableTag)
+		mockSource.AssertExpectations(t)
+	})
+
+	t.Run("healthcheck command", func(t *testing.T) {
+		info := &lib.ReleaseInfo{Tag: "latest", Directives: &lib.Directives{
+			CanaryWindow:       time.Nanosecond,
+			HealthCheckCommand: "../testdata/always_fail.sh",
+		}}
+		run := func(allow bool) error {
+			assert.NoError(t, redisClient.FlushAll(context.Background()).Err())
+			redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+			mockSource := new(MockReleaseSource)
+			mockSource.On("ResolveRelease", "latest").Return(info, nil)
+			mockSource.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+
+			c := *config
+			c.AllowDirectiveCommands = allow
+			os.Setenv("TEST_VERSION", "stable")
+			return handleCanaryRelease(context.Background(), &c, mockSource, state)
+		}
+
+		// the release notes can't run a command on the hosts unless it is allowed
+		assert.NoError(t, run(false))
+		assert.True(t, errors.Is(run(true), ErrNoRollback))
+	})
+}
+
+func TestReuploadedAssets(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	assert.NoError(t, redisClient.FlushAll(context.Background()).Err())
+
+	root := t.TempDir()
+	asset := filepath.Join(root, "v1.0.0", "app_v1.0.0.deb")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(asset), 0755))
+	assert.NoError(t, os.WriteFile(asset, []byte("broken"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "v1.0.0", "release.json"), []byte(`{"published_at":"2024-01-01T00:00:00Z"}`), 0644))
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	newConfig := func() *lib.Config {
+		return &lib.Config{
+			Source:              lib.SourceMirror,
+			MirrorURL:           root,
+			Repo:                "foo/bar",
+			SaveAssetsPath:      t.TempDir(),
+			PackageNamePattern:  `\.deb$`,
+			Redis:               &lib.RedisConfig{Host: redisHost, Port: 6379},
+			DeployCommand:       "../testdata/always_succes.sh",
+			VersionCommand:      "../testdata/echo_version.sh",
+			HealthCheckCommand:  "../testdata/always_succes.sh",
+			HealthCheckInterval: time.Nanosecond,
+			HealthCheckTimeout:  time.Second,
+			HealthCheckRetries:  1,
+			CanaryRolloutWindow: time.Nanosecond,
+			RolloutWindow:       time.Second,
+			ReuploadPolicy:      lib.ReuploadPolicyCanary,
+		}
+	}
+	canaryConfig := newConfig()
+	rolloutConfig := newConfig()
+
+	run := func(config *lib.Config, version string, f func(context.Context, *lib.Config, lib.ReleaseSource, *lib.State) error) {
+		os.Setenv("TEST_VERSION", version)
+		source, err := lib.NewReleaseSource(config)
+		assert.NoError(t, err)
+		state, err := lib.NewState(config)
+		assert.NoError(t, err)
+		assert.NoError(t, f(context.Background(), config, source, state))
+		assert.NoError(t, redisClient.Del(context.Background(), "foo/bar_rollout").Err())
+	}
+	content := func(config *lib.Config) string {
+		b, err := os.ReadFile(filepath.Join(config.SaveAssetsPath, "v1.0.0", "app_v1.0.0.deb"))
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	run(canaryConfig, "v0.9.0", handleCanaryRelease)
+	run(rolloutConfig, "v0.9.0", handleRollout)
+	assert.Equal(t, "broken", content(canaryConfig))
+	assert.Equal(t, "broken", content(rolloutConfig))
+
+	// the maintainer replaces the asset under the same tag
+	assert.NoError(t, os.WriteFile(asset, []byte("fixed"), 0644))
+	assert.NoError(t, os.Chtimes(asset, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+
+	run(canaryConfig, "v1.0.0", handleCanaryRelease)
+	assert.Equal(t, "fixed", content(canaryConfig))
+
+	run(rolloutConfig, "v1.0.0", handleRollout)
+	assert.Equal(t, "fixed", content(rolloutConfig))
+
+	// nothing happens after the re-upload is released
+	run(canaryConfig, "v1.0.0", handleCanaryRelease)
+	err := func() error {
+		os.Setenv("TEST_VERSION", "v1.0.0")
+		source, _ := lib.NewReleaseSource(rolloutConfig)
+		state, _ := lib.NewState(rolloutConfig)
+		return handleRollout(context.Background(), rolloutConfig, source, state)
+	}()
+	assert.True(t, errors.Is(err, lib.ErrAlreadyInstalled))
+}
+
+func TestReuploadedAssetsWhileSettling(t *testing.T) {
+	root := t.TempDir()
+	asset := filepath.Join(root, "v1.0.0", "app_v1.0.0.deb")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(asset), 0755))
+	assert.NoError(t, os.WriteFile(asset, []byte("broken"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "v1.0.0", "release.json"), []byte(`{"published_at":"2024-01-01T00:00:00Z"}`), 0644))
+
+	config := &lib.Config{
+		Source:              lib.SourceMirror,
+		MirrorURL:           root,
+		Repo:                "foo/bar",
+		StateBackend:        lib.StateBackendFile,
+		FileState:           &lib.FileStateConfig{Dir: t.TempDir()},
+		SaveAssetsPath:      t.TempDir(),
+		PackageNamePattern:  `\.deb$`,
+		DeployCommand:       "../testdata/always_succes.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/always_succes.sh",
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Nanosecond,
+		RolloutWindow:       time.Second,
+		ReuploadPolicy:      lib.ReuploadPolicyCanary,
+		MinReleaseAge:       time.Hour,
+	}
+	source, err := lib.NewReleaseSource(config)
+	assert.NoError(t, err)
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	content := func() string {
+		b, err := os.ReadFile(filepath.Join(config.SaveAssetsPath, "v1.0.0", "app_v1.0.0.deb"))
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	os.Setenv("TEST_VERSION", "v0.9.0")
+	assert.NoError(t, handleCanaryRelease(context.Background(), config, source, state))
+	assert.Equal(t, "broken", content())
+
+	// the re-upload waits for the assets to settle
+	assert.NoError(t, os.WriteFile(asset, []byte("fixed"), 0644))
+	assert.NoError(t, os.Chtimes(asset, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	os.Setenv("TEST_VERSION", "v1.0.0")
+	err = handleCanaryRelease(context.Background(), config, source, state)
+	assert.True(t, errors.Is(err, lib.ErrReleaseSettling))
+
+	// and it is released by canary release after it settled
+	config.MinReleaseAge = time.Nanosecond
+	assert.NoError(t, handleCanaryRelease(context.Background(), config, source, state))
+	assert.Equal(t, "fixed", content())
+}
+
+func TestRollbackWithCachedAsset(t *testing.T) {
+	root := t.TempDir()
+	for tag, published := range map[string]string{"v1.0.0": "2024-01-01T00:00:00Z", "v1.1.0": "2024-02-01T00:00:00Z"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, tag), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(root, tag, "app.deb"), []byte("content of "+tag), 0644))
+		assert.NoError(t, os.WriteFile(filepath.Join(root, tag, "release.json"), []byte(fmt.Sprintf(`{"published_at":%q}`, published)), 0644))
+	}
+
+	config := &lib.Config{
+		Source:             lib.SourceMirror,
+		MirrorURL:          root,
+		Repo:               "foo/bar",
+		StateBackend:       lib.StateBackendFile,
+		FileState:          &lib.FileStateConfig{Dir: t.TempDir()},
+		SaveAssetsPath:     t.TempDir(),
+		PackageNamePattern: `\.deb$`,
+		DeployCommand:      "../testdata/always_succes.sh",
+		VersionCommand:     "../testdata/echo_version.sh",
+		// the release source is unreachable after the canary is deployed
+		HealthCheckCommand:  fmt.Sprintf("rm -rf %s; exit 1", root),
+		RollbackCommand:     `test "$(cat "$ASSET_FILE")" = "content of v1.0.0"`,
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Second,
+		RolloutWindow:       time.Second,
+	}
+	source, err := lib.NewReleaseSource(config)
+	assert.NoError(t, err)
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	// v1.0.0 is deployed as the stable release
+	_, _, err = source.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.NoError(t, lib.NewAssetCache(config.SaveAssetsPath).MarkDeployed("v1.0.0"))
+	assert.NoError(t, state.SaveStableReleaseTag("v1.0.0"))
+	os.Setenv("TEST_VERSION", "v1.0.0")
+
+	// the canary of v1.1.0 has the same asset name and rolls back to the cached asset of v1.0.0
+	err = handleCanaryRelease(context.Background(), config, source, state)
+	assert.True(t, errors.Is(err, ErrRollback))
+}
+
+func TestRunServerShutdown(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "v1.0.0"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "v1.0.0", "app_v1.0.0.deb"), []byte("v1.0.0"), 0644))
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Source:                   lib.SourceMirror,
+		MirrorURL:                root,
+		Repo:                     "foo/bar",
+		SaveAssetsPath:           t.TempDir(),
+		PackageNamePattern:       `\.deb$`,
+		Redis:                    &lib.RedisConfig{Host: redisHost, Port: 6379},
+		RepositryPollingInterval: time.Hour,
+		RolloutWindow:            time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	done := make(chan error)
+	go func() { done <- runServer(ctx, config) }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("runServer didn't return on shutdown")
+	}
+}
+
+func TestHandleCanaryReleaseWithFileState(t *testing.T) {
+	config := &lib.Config{
+		Repo:         "foo/bar",
+		StateBackend: lib.StateBackendFile,
+		FileState: &lib.FileStateConfig{
+			Dir: t.TempDir(),
+		},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/dummy.sh",
+		RollbackCommand:     "../testdata/dummy.sh",
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Nanosecond,
+		RolloutWindow:       time.Second,
+	}
+
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	assert.NoError(t, state.SaveStableReleaseTag("stable"))
+	os.Setenv("TEST_VERSION", "notinstalled")
+
+	mockSource := new(MockReleaseSource)
+	mockSource.On("ResolveRelease", "latest").Return(&lib.ReleaseInfo{Tag: "latest"}, nil)
+	mockSource.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+
+	assert.NoError(t, handleCanaryRelease(context.Background(), config, mockSource, state))
+	stableTag, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", stableTag)
+
+	// the lock of the canary release is released
+	lease, err := state.TryCanaryReleaseLock("latest", time.Minute)
+	assert.NoError(t, err)
+	assert.NotNil(t, lease)
+}
+
+func TestCheckCanaryRollsBackWithoutLease(t *testing.T) {
+	config := &lib.Config{
+		Repo:                "foo/bar",
+		StateBackend:        lib.StateBackendFile,
+		FileState:           &lib.FileStateConfig{Dir: t.TempDir()},
+		SaveAssetsPath:      t.TempDir(),
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/always_fail.sh",
+		RollbackCommand:     "../testdata/always_succes.sh",
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		RolloutWindow:       time.Second,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	assert.NoError(t, state.SaveStableReleaseTag("stable"))
+	os.Setenv("TEST_VERSION", "latest")
+
+	// the lease is lost during the health check, e.g. the key is lost by a failover
+	lease, err := state.TryCanaryReleaseLock("latest", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, lease.Release())
+
+	canary := &lib.CanaryRecord{
+		Release:     &lib.ReleaseInfo{Tag: "latest"},
+		PreviousTag: "stable",
+		Window:      10 * time.Millisecond,
+		File:        "assetfile",
+	}
+	assert.NoError(t, state.SaveCanaryPhase(canary, lib.CanaryPhaseChecking))
+
+	mockSource := new(MockReleaseSource)
+	mockSource.On("DownloadReleaseAsset", "stable").Return("stable", "assetfile", nil)
+	err = checkCanary(context.Background(), config, mockSource, state, lease, canary, canary.Window)
+	assert.True(t, errors.Is(err, ErrRollback))
+	mockSource.AssertExpectations(t)
+
+	record, err := state.CanaryRecord()
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestCheckCanaryAbortsOnLostLease(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	assert.NoError(t, redisClient.FlushAll(context.Background()).Err())
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo:                "foo/bar",
+		Redis:               &lib.RedisConfig{Host: redisHost, Port: 6379},
+		SaveAssetsPath:      t.TempDir(),
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/always_succes.sh",
+		RollbackCommand:     "../testdata/always_succes.sh",
+		HealthCheckInterval: time.Hour,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		RolloutWindow:       time.Second,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	assert.NoError(t, state.SaveStableReleaseTag("stable"))
+	os.Setenv("TEST_VERSION", "latest")
+
+	lease, err := state.TryCanaryReleaseLock("latest", time.Nanosecond)
+	assert.NoError(t, err)
+	lease.KeepAlive()
+	defer lease.Stop()
+	// another member takes over the lock during the health check
+	assert.NoError(t, redisClient.Set(context.Background(), "foo/bar_canary_release_tag", "other", time.Minute).Err())
+
+	canary := &lib.CanaryRecord{
+		Release:     &lib.ReleaseInfo{Tag: "latest"},
+		PreviousTag: "stable",
+		Window:      time.Hour,
+		File:        "assetfile",
+	}
+	assert.NoError(t, state.SaveCanaryPhase(canary, lib.CanaryPhaseChecking))
+
+	mockSource := new(MockReleaseSource)
+	mockSource.On("DownloadReleaseAsset", "stable").Return("stable", "assetfile", nil)
+	done := make(chan error)
+	go func() {
+		done <- checkCanary(context.Background(), config, mockSource, state, lease, canary, canary.Window)
+	}()
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, ErrRollback))
+	case <-time.After(10 * time.Second):
+		t.Fatal("health check isn't aborted")
+	}
+	mockSource.AssertExpectations(t)
+
+	stableTag, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "stable", stableTag)
+}
+
+func TestRecoverCanary(t *testing.T) {
+	testCases := []struct {
+		name        string
+		phase       string
+		version     string
+		otherLock   bool
+		mockSetup   func(*MockReleaseSource)
+		wantErr     error
+		wantStable  string
+		wantRelease bool
+	}{
+		{
+			name:        "resume health check",
+			phase:       lib.CanaryPhaseChecking,
+			version:     "latest",
+			mockSetup:   func(m *MockReleaseSource) {},
+			wantStable:  "latest",
+			wantRelease: true,
+		},
+		{
+			name:    "roll back half deployed canary",
+			phase:   lib.CanaryPhaseDeploying,
+			version: "latest",
+			mockSetup: func(m *MockReleaseSource) {
+				m.On("DownloadReleaseAsset", "stable").Return("stable", "assetfile", nil)
+			},
+			wantErr:     ErrRollback,
+			wantStable:  "stable",
+			wantRelease: true,
+		},
+		{
+			name:      "roll back when the lock is taken over",
+			phase:     lib.CanaryPhaseChecking,
+			version:   "latest",
+			otherLock: true,
+			mockSetup: func(m *MockReleaseSource) {
+				m.On("DownloadReleaseAsset", "stable").Return("stable", "assetfile", nil)
+			},
+			wantErr:    ErrRollback,
+			wantStable: "stable",
+		},
+		{
+			name:        "canary is not deployed yet",
+			phase:       lib.CanaryPhaseDeploying,
+			version:     "stable",
+			mockSetup:   func(m *MockReleaseSource) {},
+			wantStable:  "stable",
+			wantRelease: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &lib.Config{
+				Repo:         "foo/bar",
+				StateBackend: lib.StateBackendFile,
+				FileState: &lib.FileStateConfig{
+					Dir: t.TempDir(),
+				},
+				SaveAssetsPath:      t.TempDir(),
+				DeployCommand:       "../testdata/dummy.sh",
+				VersionCommand:      "../testdata/echo_version.sh",
+				HealthCheckCommand:  "../testdata/dummy.sh",
+				RollbackCommand:     "../testdata/always_succes.sh",
+				HealthCheckInterval: time.Nanosecond,
+				HealthCheckTimeout:  time.Second,
+				HealthCheckRetries:  1,
+				RolloutWindow:       time.Second,
+			}
+			state, err := lib.NewState(config)
+			assert.NoError(t, err)
+			assert.NoError(t, state.SaveStableReleaseTag("stable"))
+			os.Setenv("TEST_VERSION", tc.version)
+
+			// the canary release left by the crash
+			window := time.Minute
+			lockTag := "latest"
+			if tc.otherLock {
+				lockTag = "other"
+			}
+			lease, err := state.TryCanaryReleaseLock(lockTag, window)
+			assert.NoError(t, err)
+			assert.NotNil(t, lease)
+			canary := &lib.CanaryRecord{
+				Release:     &lib.ReleaseInfo{Tag: "latest"},
+				PreviousTag: "stable",
+				// the window is almost over when the member restarts
+				Window: 10 * time.Millisecond,
+				File:   "assetfile",
+			}
+			assert.NoError(t, state.SaveCanaryPhase(canary, tc.phase))
+
+			mockSource := new(MockReleaseSource)
+			tc.mockSetup(mockSource)
+			err = recoverCanary(context.Background(), config, mockSource, state)
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+			} else {
+				assert.NoError(t, err)
+			}
+			mockSource.AssertExpectations(t)
+
+			stableTag, err := state.CurrentStableTag()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantStable, stableTag)
 
+			record, err := state.CanaryRecord()
+			assert.NoError(t, err)
+			assert.Nil(t, record)
+
+			next, err := state.TryCanaryReleaseLock("latest", window)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRelease, next != nil)
 		})
 	}
+
+	t.Run("restart after rollback failed", func(t *testing.T) {
+		config := &lib.Config{
+			Repo:            "foo/bar",
+			StateBackend:    lib.StateBackendFile,
+			FileState:       &lib.FileStateConfig{Dir: t.TempDir()},
+			SaveAssetsPath:  t.TempDir(),
+			VersionCommand:  "../testdata/echo_version.sh",
+			RollbackCommand: "../testdata/always_fail.sh",
+		}
+		state, err := lib.NewState(config)
+		assert.NoError(t, err)
+		assert.NoError(t, state.SaveStableReleaseTag("stable"))
+		os.Setenv("TEST_VERSION", "latest")
+
+		canary := &lib.CanaryRecord{
+			Release:     &lib.ReleaseInfo{Tag: "latest"},
+			PreviousTag: "stable",
+			Window:      10 * time.Millisecond,
+		}
+		assert.NoError(t, state.SaveCanaryPhase(canary, lib.CanaryPhaseDeploying))
+
+		mockSource := new(MockReleaseSource)
+		mockSource.On("DownloadReleaseAsset", "stable").Return("stable", "assetfile", nil)
+		err = recoverCanary(context.Background(), config, mockSource, state)
+		assert.True(t, errors.Is(err, ErrRollbackFailed))
+
+		record, err := state.CanaryRecord()
+		assert.NoError(t, err)
+		assert.NotNil(t, record)
+		assert.Equal(t, lib.CanaryPhaseRollbackFailed, record.Phase)
+
+		// the next restart reports the failure without running the rollback again
+		assert.NoError(t, recoverCanary(context.Background(), config, new(MockReleaseSource), state))
+		record, err = state.CanaryRecord()
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("nothing is left", func(t *testing.T) {
+		config := &lib.Config{
+			Repo:           "foo/bar",
+			StateBackend:   lib.StateBackendFile,
+			FileState:      &lib.FileStateConfig{Dir: t.TempDir()},
+			VersionCommand: "../testdata/echo_version.sh",
+		}
+		state, err := lib.NewState(config)
+		assert.NoError(t, err)
+		assert.NoError(t, recoverCanary(context.Background(), config, new(MockReleaseSource), state))
+	})
 }
@@ -0,0 +1,570 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+)
+
+var ErrAssetsNotFound = errors.New("no match assets")
+
+var ErrAssetsCannotDownload = errors.New("assets cannot download")
+
+const LatestTag = "latest"
+
+// extractDirName is the directory under the directory of the tag where the archives are extracted
+const extractDirName = "extracted"
+
+const (
+	ReleaseSelectionLatest = "latest"
+	ReleaseSelectionSemver = "semver"
+)
+
+// assetPattern selects an asset of the release, the first pattern is the primary asset(ASSET_FILE)
+type assetPattern struct {
+	name    string
+	reg     *regexp.Regexp
+	extract bool
+}
+
+// assetDownloader shares release selection, asset pattern matching, caching and verification across backends
+type assetDownloader struct {
+	backend            releaseBackend
+	config             *Config
+	patterns           []*assetPattern
+	regChecksumPattern *regexp.Regexp
+	regTagInclude      *regexp.Regexp
+	regTagExclude      *regexp.Regexp
+	versionConstraint  *semver.Constraints
+	keyring            *keyring
+	cache              *AssetCache
+}
+
+func newAssetDownloader(config *Config, backend releaseBackend) (*assetDownloader, error) {
+	var regChecksumPattern *regexp.Regexp
+	if config.ChecksumPattern != "" {
+		r, err := regexp.Compile(config.ChecksumPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum pattern: %s", err)
+		}
+		regChecksumPattern = r
+	}
+
+	if config.ReleaseSelection != ReleaseSelectionSemver &&
+		(config.VersionConstraint != "" || config.TagIncludePattern != "" || config.TagExcludePattern != "") {
+		return nil, fmt.Errorf("version_constraint and tag patterns require release_selection = %q", ReleaseSelectionSemver)
+	}
+
+	var versionConstraint *semver.Constraints
+	if config.VersionConstraint != "" {
+		c, err := semver.NewConstraint(config.VersionConstraint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint: %s", err)
+		}
+		versionConstraint = c
+	}
+
+	var regTagInclude, regTagExclude *regexp.Regexp
+	if config.TagIncludePattern != "" {
+		r, err := regexp.Compile(config.TagIncludePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag include pattern: %s", err)
+		}
+		regTagInclude = r
+	}
+	if config.TagExcludePattern != "" {
+		r, err := regexp.Compile(config.TagExcludePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag exclude pattern: %s", err)
+		}
+		regTagExclude = r
+	}
+
+	hostVars, err := newHostVars(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []*assetPattern
+	if config.PackageNamePattern != "" {
+		r, err := compileAssetPattern(hostVars, config.PackageNamePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package name pattern: %s", err)
+		}
+		patterns = append(patterns, &assetPattern{reg: r})
+	}
+	for _, a := range config.Assets {
+		r, err := compileAssetPattern(hostVars, a.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid asset pattern %s: %s", a.Name, err)
+		}
+		patterns = append(patterns, &assetPattern{name: a.Name, reg: r, extract: a.Extract})
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("package_name_pattern or assets is required")
+	}
+
+	var kr *keyring
+	if config.SignatureKeyring != "" {
+		k, err := loadKeyring(config.SignatureKeyring)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signature keyring: %s", err)
+		}
+		kr = k
+	}
+
+	return &assetDownloader{
+		backend:            backend,
+		config:             config,
+		patterns:           patterns,
+		regChecksumPattern: regChecksumPattern,
+		regTagInclude:      regTagInclude,
+		regTagExclude:      regTagExclude,
+		versionConstraint:  versionConstraint,
+		keyring:            kr,
+		cache:              NewAssetCache(config.SaveAssetsPath),
+	}, nil
+}
+
+// listReleases, latestRelease and releaseByTag call the backend with the request timeout and retry
+func (d *assetDownloader) listReleases(ctx context.Context) ([]*release, error) {
+	var ret []*release
+	err := d.withRetry(ctx, d.requestTimeout(), func(ctx context.Context) error {
+		r, err := d.backend.listReleases(ctx)
+		ret = r
+		return err
+	})
+	return ret, err
+}
+
+func (d *assetDownloader) latestRelease(ctx context.Context) (*release, error) {
+	var ret *release
+	err := d.withRetry(ctx, d.requestTimeout(), func(ctx context.Context) error {
+		r, err := d.backend.latestRelease(ctx)
+		ret = r
+		return err
+	})
+	return ret, err
+}
+
+func (d *assetDownloader) releaseByTag(ctx context.Context, tag string) (*release, error) {
+	var ret *release
+	err := d.withRetry(ctx, d.requestTimeout(), func(ctx context.Context) error {
+		r, err := d.backend.releaseByTag(ctx, tag)
+		ret = r
+		return err
+	})
+	return ret, err
+}
+
+func (d *assetDownloader) searchReleaseWithPreRelease(ctx context.Context) (*release, error) {
+	allReleases, err := d.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// sort by published date desc
+	for i := 0; i < len(allReleases); i++ {
+		for j := i + 1; j < len(allReleases); j++ {
+			if allReleases[i].publishedAt.Before(allReleases[j].publishedAt) {
+				allReleases[i], allReleases[j] = allReleases[j], allReleases[i]
+			}
+		}
+	}
+
+	for _, r := range allReleases {
+		if r.draft {
+			continue
+		}
+		if r.prerelease {
+			return r, nil
+		}
+	}
+	return nil, ErrAssetsNotFound
+}
+
+// matchTag reports whether the tag passes the include/exclude filters and the version constraint
+func (d *assetDownloader) matchTag(tag string) (*semver.Version, bool) {
+	if d.regTagInclude != nil && !d.regTagInclude.MatchString(tag) {
+		return nil, false
+	}
+	if d.regTagExclude != nil && d.regTagExclude.MatchString(tag) {
+		return nil, false
+	}
+
+	v, err := semver.NewVersion(tag)
+	if err != nil {
+		slog.Debug("skip tag which is not semver", "tag", tag)
+		return nil, false
+	}
+
+	if d.versionConstraint != nil {
+		cv := *v
+		// prereleases are compared by their core version when include_prerelease is enabled
+		if d.config.IncludePreRelease && v.Prerelease() != "" {
+			cv, _ = v.SetPrerelease("")
+		}
+		if !d.versionConstraint.Check(&cv) {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// searchReleaseWithSemver returns the highest version release matching the selection policy
+func (d *assetDownloader) searchReleaseWithSemver(ctx context.Context) (*release, error) {
+	allReleases, err := d.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *release
+	var latest *semver.Version
+	for _, r := range allReleases {
+		if r.draft {
+			continue
+		}
+		if r.prerelease && !d.config.IncludePreRelease {
+			continue
+		}
+
+		v, ok := d.matchTag(r.tag)
+		if !ok {
+			continue
+		}
+
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+			found = r
+		}
+	}
+
+	if found == nil {
+		return nil, ErrAssetsNotFound
+	}
+	return found, nil
+}
+
+// wrapSourceError keeps ErrRateLimited so that the caller can back off until the limit is reset
+func wrapSourceError(err error, msg string) error {
+	if errors.Is(err, ErrRateLimited) {
+		return err
+	}
+	return errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("%s error: %v", msg, err))
+}
+
+func (d *assetDownloader) resolveRelease(ctx context.Context, tag string) (*release, error) {
+	if tag == LatestTag && d.config.ReleaseSelection == ReleaseSelectionSemver {
+		r, err := d.searchReleaseWithSemver(ctx)
+		if err != nil {
+			if err == ErrAssetsNotFound {
+				return nil, err
+			}
+			return nil, wrapSourceError(err, "list releases returned")
+		}
+		return r, nil
+	}
+
+	if tag == LatestTag {
+		r, err := d.latestRelease(ctx)
+		if err != nil {
+			if !d.config.IncludePreRelease || errors.Is(err, ErrRateLimited) {
+				return nil, wrapSourceError(err, fmt.Sprintf("get release returned tag:%s", tag))
+			}
+		}
+
+		found := r
+		if d.config.IncludePreRelease {
+			inPrerelease, err := d.searchReleaseWithPreRelease(ctx)
+			if err != nil {
+				if err != ErrAssetsNotFound {
+					return nil, wrapSourceError(err, "list releases returned")
+				}
+			}
+
+			// プレリリースが最新の場合はプレリリースを返す
+			if inPrerelease != nil && (r == nil || inPrerelease.publishedAt.After(r.publishedAt)) {
+				found = inPrerelease
+			}
+		}
+
+		if found == nil {
+			return nil, ErrAssetsNotFound
+		}
+		return found, nil
+	}
+
+	r, err := d.releaseByTag(ctx, tag)
+	if err != nil {
+		return nil, wrapSourceError(err, fmt.Sprintf("get release returned tag:%s", tag))
+	}
+	return r, nil
+}
+
+// compileAssetPattern resolves the template variables of the host once at startup
+func compileAssetPattern(v *HostVars, pattern string) (*regexp.Regexp, error) {
+	resolved, err := v.resolvePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if resolved != pattern {
+		slog.Info("asset pattern resolved", "pattern", pattern, "resolved", resolved)
+	}
+	return regexp.Compile(resolved)
+}
+
+func (p *assetPattern) find(release *release) *releaseAsset {
+	for _, asset := range release.assets {
+		slog.Debug("assets info", "name", asset.name, "download url", asset.url)
+		if p.reg.MatchString(asset.name) {
+			return asset
+		}
+	}
+	return nil
+}
+
+// matchAssets returns the first name matched by each asset pattern
+func (d *assetDownloader) matchAssets(names []string) []string {
+	var ret []string
+	for _, p := range d.patterns {
+		for _, name := range names {
+			if p.reg.MatchString(name) {
+				ret = append(ret, name)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// ResolveRelease returns the release metadata without downloading the asset
+func (d *assetDownloader) ResolveRelease(ctx context.Context, tag string) (*ReleaseInfo, error) {
+	release, err := d.resolveRelease(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	asset := d.patterns[0].find(release)
+	if asset == nil {
+		return nil, ErrAssetsNotFound
+	}
+
+	info := &ReleaseInfo{
+		Tag:            release.tag,
+		Asset:          asset.name,
+		Size:           asset.size,
+		AssetID:        asset.id,
+		AssetUpdatedAt: asset.updatedAt,
+		PublishedAt:    release.publishedAt,
+		AssetSet:       release.assetSet(),
+		Fingerprints:   release.fingerprints(),
+		Directives:     parseDirectives(release.tag, release.body),
+	}
+	names := make([]string, 0, len(release.assets))
+	for _, a := range release.assets {
+		names = append(names, a.name)
+	}
+	info.Matched = d.matchAssets(names)
+	// the checksums are read only when the asset is downloaded, the cached asset is already verified by them
+	if entry, err := d.cache.find(release.tag, asset.name); err != nil {
+		slog.Warn("can't read asset index", "path", d.cache.indexPath(), "err", err)
+	} else if entry != nil && !entry.reuploaded(asset) {
+		info.Digest = entry.Digest
+	}
+	return info, nil
+}
+
+// assetDir is the directory where the assets of the tag are saved, so that the assets of the tags don't overwrite each other
+func (d *assetDownloader) assetDir(tag string) string {
+	return filepath.Join(d.config.SaveAssetsPath, strings.ReplaceAll(tag, "/", "_"))
+}
+
+// extractDir is the directory where the archives of the tag are extracted
+func (d *assetDownloader) extractDir(tag string) string {
+	return filepath.Join(d.assetDir(tag), extractDirName)
+}
+
+// DownloadReleaseAsset downloads all the assets matching the patterns and returns the primary asset.
+// The other assets are recorded in the asset index and exposed to the hooks by AssetEnv.
+func (d *assetDownloader) DownloadReleaseAsset(ctx context.Context, tag string) (string, string, error) {
+	release, err := d.resolveRelease(ctx, tag)
+	if err != nil {
+		return "", "", err
+	}
+
+	slog.Debug("tag info", "latest release Tag", release.tag)
+	primary := ""
+	for i, p := range d.patterns {
+		asset := p.find(release)
+		if asset == nil {
+			if i == 0 {
+				return "", "", ErrAssetsNotFound
+			}
+			return release.tag, "", errors.Wrap(ErrAssetsNotFound, fmt.Sprintf("asset:%s tag:%s", p.name, release.tag))
+		}
+
+		filePath, err := d.fetchAsset(ctx, release, asset)
+		if err != nil {
+			return release.tag, "", err
+		}
+
+		entry := &CachedAsset{
+			Tag:       release.tag,
+			Name:      asset.name,
+			Label:     p.name,
+			Primary:   i == 0,
+			Path:      filePath,
+			Size:      asset.size,
+			AssetID:   asset.id,
+			UpdatedAt: asset.updatedAt,
+		}
+		if p.extract {
+			entry.Dir = d.extractDir(release.tag)
+			if err := extractArchive(filePath, entry.Dir); err != nil {
+				return release.tag, "", fmt.Errorf("can't extract asset:%s %w", asset.name, err)
+			}
+			slog.Info("asset extracted", "tag", release.tag, "asset", asset.name, "dir", entry.Dir)
+		}
+
+		if err := d.cache.add(entry); err != nil {
+			slog.Warn("can't update asset index", "path", d.cache.indexPath(), "err", err)
+		}
+
+		if i == 0 {
+			primary = filePath
+		}
+	}
+
+	return release.tag, primary, nil
+}
+
+// fetchAsset downloads the asset unless it is cached and verifies it
+func (d *assetDownloader) fetchAsset(ctx context.Context, release *release, asset *releaseAsset) (string, error) {
+	filePath := filepath.Join(d.assetDir(release.tag), asset.name)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", err
+	}
+
+	cached, err := d.validCachedAsset(release.tag, asset, filePath)
+	if err != nil {
+		return "", err
+	}
+	if !cached {
+		if err := d.downloadAsset(ctx, asset, filePath); err != nil {
+			return "", err
+		}
+	}
+
+	if err := d.verifyAsset(ctx, release, asset, filePath); err != nil {
+		if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrSignatureInvalid) {
+			if err := os.Remove(filePath); err != nil {
+				slog.Warn("can't remove invalid asset", "path", filePath, "err", err)
+			}
+		}
+		return "", err
+	}
+	return filePath, nil
+}
+
+func (d *assetDownloader) readAsset(ctx context.Context, asset *releaseAsset) ([]byte, error) {
+	var b []byte
+	err := d.withRetry(ctx, d.requestTimeout(), func(ctx context.Context) error {
+		ret, _, err := d.backend.openAsset(ctx, asset, 0)
+		if err != nil {
+			return err
+		}
+		defer ret.Close()
+
+		b, err = io.ReadAll(ret)
+		return err
+	})
+	if err != nil {
+		return nil, wrapSourceError(err, fmt.Sprintf("asset:%s", asset.name))
+	}
+	return b, nil
+}
+
+// verifyAsset is the verification stage after download
+func (d *assetDownloader) verifyAsset(ctx context.Context, release *release, asset *releaseAsset, filePath string) error {
+	if err := d.verifyChecksum(ctx, release, asset, filePath); err != nil {
+		return err
+	}
+	return d.verifySignature(ctx, release, asset, filePath)
+}
+
+func (d *assetDownloader) findChecksumAsset(release *release) *releaseAsset {
+	if d.regChecksumPattern == nil {
+		return nil
+	}
+	for _, asset := range release.assets {
+		if d.regChecksumPattern.MatchString(asset.name) {
+			return asset
+		}
+	}
+	return nil
+}
+
+// verifyChecksum verifies the downloaded file when the release publishes a checksums asset
+func (d *assetDownloader) verifyChecksum(ctx context.Context, release *release, asset *releaseAsset, filePath string) error {
+	sumsAsset := d.findChecksumAsset(release)
+	if sumsAsset == nil {
+		slog.Debug("checksums asset not found, skip verification", "tag", release.tag)
+		return nil
+	}
+
+	sums, err := d.readAsset(ctx, sumsAsset)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyChecksum(filePath, asset.name, sums); err != nil {
+		return err
+	}
+	slog.Info("asset checksum verified", "tag", release.tag, "asset", asset.name, "checksums", sumsAsset.name)
+	return nil
+}
+
+func findSignatureAsset(release *release, name string) *releaseAsset {
+	for _, suffix := range signatureSuffixes {
+		for _, asset := range release.assets {
+			if asset.name == name+suffix {
+				return asset
+			}
+		}
+	}
+	return nil
+}
+
+// verifySignature verifies the detached signature asset when a keyring is configured
+func (d *assetDownloader) verifySignature(ctx context.Context, release *release, asset *releaseAsset, filePath string) error {
+	if d.keyring == nil {
+		return nil
+	}
+
+	sigAsset := findSignatureAsset(release, asset.name)
+	if sigAsset == nil {
+		slog.Error("asset signature verification failed", "tag", release.tag, "asset", asset.name, "err", "signature not found")
+		return errors.Wrap(ErrSignatureInvalid, fmt.Sprintf("asset:%s signature not found", asset.name))
+	}
+
+	sig, err := d.readAsset(ctx, sigAsset)
+	if err != nil {
+		return err
+	}
+
+	signer, err := d.keyring.verify(filePath, sigAsset.name, sig)
+	if err != nil {
+		slog.Error("asset signature verification failed", "tag", release.tag, "asset", asset.name, "signature", sigAsset.name, "err", err)
+		return err
+	}
+	slog.Info("asset signature verified", "tag", release.tag, "asset", asset.name, "signature", sigAsset.name, "signer", signer)
+	return nil
+}
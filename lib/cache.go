@@ -0,0 +1,394 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// index of the downloaded assets placed in SaveAssetsPath
+const assetIndexFile = ".gacr-index.json"
+
+type CachedAsset struct {
+	Tag          string    `json:"tag"`
+	Name         string    `json:"name"`
+	Label        string    `json:"label,omitempty"` // name of the asset pattern, empty for package_name_pattern
+	Primary      bool      `json:"primary,omitempty"`
+	Path         string    `json:"path"`
+	Dir          string    `json:"dir,omitempty"` // directory where the asset is extracted
+	Size         int64     `json:"size"`
+	Digest       string    `json:"digest"`
+	AssetID      int64     `json:"asset_id,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+	DeployedAt   time.Time `json:"deployed_at,omitempty"`
+}
+
+// RetentionPolicy decides which cached assets are pruned
+type RetentionPolicy struct {
+	// keep the assets of the last N downloaded tags, 0 means unlimited
+	KeepTags int
+	// max total bytes of the assets, 0 means unlimited
+	MaxBytes int64
+}
+
+// AssetCache maintains the index of the assets downloaded into SaveAssetsPath
+type AssetCache struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewAssetCache(dir string) *AssetCache {
+	return &AssetCache{dir: dir}
+}
+
+func (c *AssetCache) indexPath() string {
+	return filepath.Join(c.dir, assetIndexFile)
+}
+
+// load reads the index and drops the entries whose file was removed
+func (c *AssetCache) load() ([]*CachedAsset, error) {
+	b, err := os.ReadFile(c.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	entries := []*CachedAsset{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("invalid asset index %s: %s", c.indexPath(), err)
+	}
+
+	ret := make([]*CachedAsset, 0, len(entries))
+	for _, e := range entries {
+		if _, err := os.Stat(e.Path); err != nil {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].DownloadedAt.After(ret[j].DownloadedAt)
+	})
+	return ret, nil
+}
+
+func (c *AssetCache) save(entries []*CachedAsset) error {
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.indexPath() + partialSuffix
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// List returns the cached assets, newest first
+func (c *AssetCache) List() ([]*CachedAsset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load()
+}
+
+func (c *AssetCache) add(entry *CachedAsset) error {
+	if entry.Size <= 0 {
+		if fi, err := os.Stat(entry.Path); err == nil {
+			entry.Size = fi.Size()
+		}
+	}
+
+	digest, err := fileDigest(entry.Path)
+	if err != nil {
+		return err
+	}
+	entry.Digest = digest
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	// the file is overwritten, the entries of the other tags at the same path are gone
+	entries = slices.DeleteFunc(entries, func(e *CachedAsset) bool {
+		return e.Path == entry.Path && (e.Tag != entry.Tag || e.Name != entry.Name)
+	})
+
+	for i, e := range entries {
+		if e.Tag == entry.Tag && e.Name == entry.Name {
+			entry.DownloadedAt = e.DownloadedAt
+			entry.DeployedAt = e.DeployedAt
+			entries[i] = entry
+			return c.save(entries)
+		}
+	}
+
+	entry.DownloadedAt = time.Now()
+	return c.save(append([]*CachedAsset{entry}, entries...))
+}
+
+// find returns the cached asset of the tag and the asset name
+func (c *AssetCache) find(tag, name string) (*CachedAsset, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Tag == tag && e.Name == name {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// reuploaded reports whether the asset is replaced since it was cached
+func (e *CachedAsset) reuploaded(asset *releaseAsset) bool {
+	if e.AssetID == 0 && e.UpdatedAt.IsZero() {
+		return false
+	}
+	return e.AssetID != asset.id || !e.UpdatedAt.Equal(asset.updatedAt)
+}
+
+// Reuploaded reports whether the cached asset differs from the asset of the release info
+func (e *CachedAsset) Reuploaded(info *ReleaseInfo) bool {
+	return e.reuploaded(&releaseAsset{id: info.AssetID, updatedAt: info.AssetUpdatedAt})
+}
+
+// Lookup returns the primary cached asset of the tag, nil if it isn't cached or any asset of the tag is broken
+func (c *AssetCache) Lookup(tag string) (*CachedAsset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *CachedAsset
+	for _, e := range entries {
+		if e.Tag != tag {
+			continue
+		}
+		if e.Digest != "" {
+			if err := verifyDigest(e.Path, e.Name, e.Digest); err != nil {
+				slog.Warn("cached asset is broken", "tag", tag, "path", e.Path, "err", err)
+				return nil, nil
+			}
+		}
+		if found == nil || (e.Primary && !found.Primary) {
+			found = e
+		}
+	}
+	return found, nil
+}
+
+// MarkDeployed records the deploy time of the tag, recently deployed tags are kept as rollback targets
+func (c *AssetCache) MarkDeployed(tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	now := time.Now()
+	for _, e := range entries {
+		if e.Tag == tag {
+			e.DeployedAt = now
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return c.save(entries)
+}
+
+// Prune removes the assets out of the retention policy and returns them.
+// The assets of the protected tags and the last two deployed tags(current and rollback target) are never removed.
+func (c *AssetCache) Prune(policy RetentionPolicy, dryRun bool, protected ...string) ([]*CachedAsset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[string]bool{}
+	for _, t := range protected {
+		if t != "" {
+			keep[t] = true
+		}
+	}
+
+	deployed := make([]*CachedAsset, 0, len(entries))
+	for _, e := range entries {
+		if !e.DeployedAt.IsZero() {
+			deployed = append(deployed, e)
+		}
+	}
+	sort.SliceStable(deployed, func(i, j int) bool {
+		return deployed[i].DeployedAt.After(deployed[j].DeployedAt)
+	})
+	deployedTags := 0
+	for _, e := range deployed {
+		if deployedTags >= 2 {
+			break
+		}
+		if !keep[e.Tag] {
+			keep[e.Tag] = true
+			deployedTags++
+		}
+	}
+
+	pruned := map[*CachedAsset]bool{}
+	if policy.KeepTags > 0 {
+		tags := map[string]bool{}
+		for _, e := range entries {
+			if len(tags) < policy.KeepTags {
+				tags[e.Tag] = true
+			}
+			if !tags[e.Tag] && !keep[e.Tag] {
+				pruned[e] = true
+			}
+		}
+	}
+
+	if policy.MaxBytes > 0 {
+		var total int64
+		for _, e := range entries {
+			if !pruned[e] {
+				total += e.Size
+			}
+		}
+		// remove the assets of the oldest tag first, the assets of a tag are removed together
+		for i := len(entries) - 1; i >= 0 && total > policy.MaxBytes; i-- {
+			if pruned[entries[i]] || keep[entries[i].Tag] {
+				continue
+			}
+			for _, e := range entries {
+				if e.Tag == entries[i].Tag && !pruned[e] {
+					pruned[e] = true
+					total -= e.Size
+				}
+			}
+		}
+	}
+
+	// the files referenced by the kept entries are never removed
+	inUse := map[string]bool{}
+	for _, e := range entries {
+		if !pruned[e] {
+			inUse[e.Path] = true
+			if e.Dir != "" {
+				inUse[e.Dir] = true
+			}
+		}
+	}
+
+	var removed []*CachedAsset
+	rest := make([]*CachedAsset, 0, len(entries))
+	for _, e := range entries {
+		if !pruned[e] {
+			rest = append(rest, e)
+			continue
+		}
+
+		if !dryRun {
+			if inUse[e.Path] {
+				slog.Debug("cached asset is used by another entry, keep the file", "path", e.Path, "tag", e.Tag)
+			} else if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+				slog.Warn("can't remove cached asset", "path", e.Path, "err", err)
+				rest = append(rest, e)
+				continue
+			}
+			if e.Dir != "" && !inUse[e.Dir] {
+				if err := os.RemoveAll(e.Dir); err != nil {
+					slog.Warn("can't remove extracted asset", "path", e.Dir, "err", err)
+				}
+			}
+			// the directory of the tag is removed with the last asset of the tag
+			if dir := filepath.Dir(e.Path); dir != filepath.Clean(c.dir) {
+				if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+					slog.Debug("directory of the tag is kept", "path", dir, "err", err)
+				}
+			}
+		}
+		removed = append(removed, e)
+	}
+
+	if dryRun || len(removed) == 0 {
+		return removed, nil
+	}
+	return removed, c.save(rest)
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var envNameReplacer = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// AssetEnv returns the environment variables of the assets downloaded with the primary asset file.
+// Each named asset is exposed as ASSET_FILE_<NAME> and the extracted directory as ASSET_DIR.
+func AssetEnv(tag, file string) []string {
+	if file == "" {
+		return nil
+	}
+
+	// the asset is saved in <SaveAssetsPath>/<tag>
+	entries, err := NewAssetCache(filepath.Dir(filepath.Dir(file))).List()
+	if err != nil {
+		slog.Warn("can't read asset index", "err", err)
+		return nil
+	}
+
+	var env []string
+	dir := ""
+	for _, e := range entries {
+		if e.Tag != tag {
+			continue
+		}
+		if e.Label != "" {
+			name := envNameReplacer.ReplaceAllString(strings.ToUpper(e.Label), "_")
+			env = append(env, fmt.Sprintf("ASSET_FILE_%s=%s", name, e.Path))
+		}
+		if e.Dir != "" {
+			dir = e.Dir
+		}
+	}
+	if dir != "" {
+		env = append(env, fmt.Sprintf("ASSET_DIR=%s", dir))
+	}
+	return env
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestAssetCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewAssetCache(dir)
+	for _, tag := range []string{"v1", "v2", "v3", "v4", "v5"} {
+		p := filepath.Join(dir, "app_"+tag+".deb")
+		assert.NoError(t, os.WriteFile(p, []byte("0123456789"), 0644))
+		assert.NoError(t, cache.add(&CachedAsset{Tag: tag, Name: filepath.Base(p), Path: p}))
+	}
+	assert.NoError(t, cache.MarkDeployed("v2"))
+	assert.NoError(t, cache.MarkDeployed("v3"))
+
+	tags := func(assets []*CachedAsset) []string {
+		ret := []string{}
+		for _, a := range assets {
+			ret = append(ret, a.Tag)
+		}
+		return ret
+	}
+
+	// the last downloaded tag, the protected tag and the last two deployed tags are kept
+	removed, err := cache.Prune(RetentionPolicy{KeepTags: 1}, true, "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v4"}, tags(removed))
+	_, err = os.Stat(filepath.Join(dir, "app_v4.deb"))
+	assert.NoError(t, err)
+
+	removed, err = cache.Prune(RetentionPolicy{KeepTags: 1}, false, "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v4"}, tags(removed))
+	_, err = os.Stat(filepath.Join(dir, "app_v4.deb"))
+	assert.True(t, os.IsNotExist(err))
+
+	assets, err := cache.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v5", "v3", "v2", "v1"}, tags(assets))
+	assert.Equal(t, int64(10), assets[0].Size)
+
+	// the rollback target is kept even if it exceeds the max bytes
+	removed, err = cache.Prune(RetentionPolicy{MaxBytes: 10}, false, "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v5"}, tags(removed))
+
+	assets, err = cache.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v3", "v2", "v1"}, tags(assets))
+}
+
+func TestAssetCachePruneSharedPath(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewAssetCache(dir)
+	p := filepath.Join(dir, "app.deb")
+	assert.NoError(t, os.WriteFile(p, []byte("0123456789"), 0644))
+	// an index written by an older version can have the entries of two tags at the same path
+	now := time.Now()
+	assert.NoError(t, cache.save([]*CachedAsset{
+		{Tag: "v2", Name: "app.deb", Path: p, Size: 10, DownloadedAt: now},
+		{Tag: "v1", Name: "app.deb", Path: p, Size: 10, DownloadedAt: now.Add(-time.Hour)},
+	}))
+
+	removed, err := cache.Prune(RetentionPolicy{KeepTags: 1}, false)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 1)
+	assert.Equal(t, "v1", removed[0].Tag)
+
+	_, err = os.Stat(p)
+	assert.NoError(t, err)
+	assets, err := cache.List()
+	assert.NoError(t, err)
+	assert.Len(t, assets, 1)
+	assert.Equal(t, "v2", assets[0].Tag)
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// BSD style: SHA256 (name) = hex
+var bsdChecksumLine = regexp.MustCompile(`^[A-Z0-9-]+ \((.+)\) = ([0-9a-fA-F]+)$`)
+
+// parseChecksums parses sha256sum/sha512sum(GNU and BSD style) output and returns name -> hex digest
+func parseChecksums(b []byte) map[string]string {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			sums[m[1]] = strings.ToLower(m[2])
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// "*" means binary mode in GNU coreutils
+		name := strings.TrimPrefix(fields[1], "*")
+		sums[name] = strings.ToLower(fields[0])
+	}
+	return sums
+}
+
+func newChecksumHash(digest string) (hash.Hash, error) {
+	switch len(digest) {
+	case sha256.Size * 2:
+		return sha256.New(), nil
+	case sha512.Size * 2:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest length: %d", len(digest))
+}
+
+// verifyChecksum checks the digest of filePath against the entry for assetName in sums
+func verifyChecksum(filePath, assetName string, sums []byte) error {
+	expected, ok := parseChecksums(sums)[assetName]
+	if !ok {
+		return errors.Wrap(ErrChecksumMismatch, fmt.Sprintf("asset:%s is not listed in checksums", assetName))
+	}
+	return verifyDigest(filePath, assetName, expected)
+}
+
+// verifyDigest checks the hex digest(sha256 or sha512) of filePath
+func verifyDigest(filePath, assetName, expected string) error {
+	h, err := newChecksumHash(expected)
+	if err != nil {
+		return errors.Wrap(ErrChecksumMismatch, fmt.Sprintf("asset:%s %v", assetName, err))
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != expected {
+		return errors.Wrap(ErrChecksumMismatch, fmt.Sprintf("asset:%s expected:%s actual:%s", assetName, expected, actual))
+	}
+	return nil
+}
@@ -3,32 +3,106 @@ package lib
 import "time"
 
 type RedisConfig struct {
-	Host      string `mapstructure:"host" validate:"required"`
-	Port      int    `mapstructure:"port" validate:"required"`
-	Password  string `mapstructure:"password"`
-	DB        int    `mapstructure:"db" validate:"required"`
+	Host             string   `mapstructure:"host" validate:"required_without=Addrs"`
+	Port             int      `mapstructure:"port" validate:"required_without=Addrs"`
+	Addrs            []string `mapstructure:"addrs"`
+	MasterName       string   `mapstructure:"master_name" validate:"excluded_with=Cluster"`
+	SentinelPassword string   `mapstructure:"sentinel_password"`
+	Cluster          bool     `mapstructure:"cluster"`
+	Username         string   `mapstructure:"username"`
+	Password         string   `mapstructure:"password"`
+	DB               int      `mapstructure:"db" validate:"required"`
+	KeyPrefix        string   `mapstructure:"key_prefix"`
+	TLS              bool     `mapstructure:"tls"`
+	TLSCACert        string   `mapstructure:"tls_ca_cert"`
+	TLSClientCert    string   `mapstructure:"tls_client_cert" validate:"required_with=TLSClientKey"`
+	TLSClientKey     string   `mapstructure:"tls_client_key" validate:"required_with=TLSClientCert"`
+	TLSServerName    string   `mapstructure:"tls_server_name"`
+}
+
+type EtcdConfig struct {
+	Endpoints []string `mapstructure:"endpoints"`
+	Username  string   `mapstructure:"username"`
+	Password  string   `mapstructure:"password"`
+	KeyPrefix string   `mapstructure:"key_prefix"`
+}
+
+type ConsulConfig struct {
+	Address    string `mapstructure:"address"`
+	Token      string `mapstructure:"token"`
+	Datacenter string `mapstructure:"datacenter"`
+	KeyPrefix  string `mapstructure:"key_prefix"`
+}
+
+// FileStateConfig is the state stored in a file for the members on a single host
+type FileStateConfig struct {
+	Dir       string `mapstructure:"dir"`
 	KeyPrefix string `mapstructure:"key_prefix"`
 }
 
+// AssetConfig is a named asset pattern, the asset is exposed to the hooks as ASSET_FILE_<NAME>
+type AssetConfig struct {
+	Name    string `mapstructure:"name" validate:"required"`
+	Pattern string `mapstructure:"pattern" validate:"required"`
+	Extract bool   `mapstructure:"extract"`
+}
+
 type Config struct {
-	GitHubToken              string        `mapstructure:"github_token"`
-	Repo                     string        `mapstructure:"repo" validate:"required"`
-	SaveAssetsPath           string        `mapstructure:"save_assets_path" validate:"required"`
-	GitHubAPIEndpoint        string        `mapstructure:"github_api"`
-	DeployCommand            string        `mapstructure:"deploy_command"  validate:"required"`
-	RollbackCommand          string        `mapstructure:"rollback_command"`
-	HealthCheckCommand       string        `mapstructure:"healthcheck_command" validate:"required"`
-	VersionCommand           string        `mapstructure:"version_command" validate:"required"`
-	HealthCheckInterval      time.Duration `mapstructure:"healthcheck_interval" validate:"required"`
-	CanaryRolloutWindow      time.Duration `mapstructure:"canary_rollout_window" validate:"required"`
-	RolloutWindow            time.Duration `mapstructure:"rollout_window" validate:"required"`
-	RepositryPollingInterval time.Duration `mapstructure:"repository_polling_interval" validate:"required"`
-	PackageNamePattern       string        `mapstructure:"package_name_pattern" validate:"required"`
-	SlackWebhookURL          string        `mapstructure:"slack_webhook_url"`
-	SlackChannel             string        `mapstructure:"slack_channel"`
-	Redis                    *RedisConfig  `mapstructure:"redis" validate:"required"`
-	LogLevel                 string        `mapstructure:"log_level"`
-	HealthCheckRetries       uint          `mapstructure:"healthcheck_retries" validate:"required"`
-	HealthCheckTimeout       time.Duration `mapstructure:"healthcheck_timeout" validate:"required"`
-	IncludePreRelease        bool          `mapstructure:"include_prerelease"`
+	Source                   string            `mapstructure:"source" validate:"omitempty,oneof=github gitlab mirror"`
+	GitHubToken              string            `mapstructure:"github_token"`
+	Repo                     string            `mapstructure:"repo" validate:"required"`
+	SaveAssetsPath           string            `mapstructure:"save_assets_path" validate:"required"`
+	GitHubAPIEndpoint        string            `mapstructure:"github_api"`
+	GitHubUploadURL          string            `mapstructure:"github_upload_url"`
+	GitHubAppID              int64             `mapstructure:"github_app_id"`
+	GitHubAppInstallationID  int64             `mapstructure:"github_app_installation_id"`
+	GitHubAppPrivateKeyPath  string            `mapstructure:"github_app_private_key_path" validate:"required_with=GitHubAppID"`
+	GitLabToken              string            `mapstructure:"gitlab_token"`
+	GitLabAPIEndpoint        string            `mapstructure:"gitlab_api"`
+	MirrorURL                string            `mapstructure:"mirror_url"`
+	RequestTimeout           time.Duration     `mapstructure:"request_timeout"`
+	DownloadTimeout          time.Duration     `mapstructure:"download_timeout"`
+	RequestRetries           uint              `mapstructure:"request_retries"`
+	TLSCACert                string            `mapstructure:"tls_ca_cert"`
+	TLSClientCert            string            `mapstructure:"tls_client_cert" validate:"required_with=TLSClientKey"`
+	TLSClientKey             string            `mapstructure:"tls_client_key" validate:"required_with=TLSClientCert"`
+	HTTPProxy                string            `mapstructure:"http_proxy"`
+	NoProxy                  string            `mapstructure:"no_proxy"`
+	DeployCommand            string            `mapstructure:"deploy_command"  validate:"required"`
+	RollbackCommand          string            `mapstructure:"rollback_command"`
+	HealthCheckCommand       string            `mapstructure:"healthcheck_command" validate:"required"`
+	VersionCommand           string            `mapstructure:"version_command" validate:"required"`
+	HealthCheckInterval      time.Duration     `mapstructure:"healthcheck_interval" validate:"required"`
+	CanaryRolloutWindow      time.Duration     `mapstructure:"canary_rollout_window" validate:"required"`
+	RolloutWindow            time.Duration     `mapstructure:"rollout_window" validate:"required"`
+	RepositryPollingInterval time.Duration     `mapstructure:"repository_polling_interval" validate:"required"`
+	PackageNamePattern       string            `mapstructure:"package_name_pattern" validate:"required_without=Assets"`
+	SlackWebhookURL          string            `mapstructure:"slack_webhook_url"`
+	SlackChannel             string            `mapstructure:"slack_channel"`
+	StateBackend             string            `mapstructure:"state_backend" validate:"omitempty,oneof=redis etcd consul file"`
+	Redis                    *RedisConfig      `mapstructure:"redis" validate:"required_if=StateBackend redis"`
+	Etcd                     *EtcdConfig       `mapstructure:"etcd" validate:"required_if=StateBackend etcd"`
+	Consul                   *ConsulConfig     `mapstructure:"consul"`
+	FileState                *FileStateConfig  `mapstructure:"file_state"`
+	LogLevel                 string            `mapstructure:"log_level"`
+	HealthCheckRetries       uint              `mapstructure:"healthcheck_retries" validate:"required"`
+	HealthCheckTimeout       time.Duration     `mapstructure:"healthcheck_timeout" validate:"required"`
+	IncludePreRelease        bool              `mapstructure:"include_prerelease"`
+	ChecksumPattern          string            `mapstructure:"checksum_pattern"`
+	SignatureKeyring         string            `mapstructure:"signature_keyring"`
+	ReleaseSelection         string            `mapstructure:"release_selection" validate:"omitempty,oneof=latest semver"`
+	VersionConstraint        string            `mapstructure:"version_constraint"`
+	TagIncludePattern        string            `mapstructure:"tag_include_pattern"`
+	TagExcludePattern        string            `mapstructure:"tag_exclude_pattern"`
+	AllowDowngradeTo         string            `mapstructure:"allow_downgrade_to"`
+	AllowDirectiveCommands   bool              `mapstructure:"allow_directive_commands"`
+	LeaderElection           bool              `mapstructure:"leader_election"`
+	LeaderLease              time.Duration     `mapstructure:"leader_lease"`
+	CacheKeepTags            int               `mapstructure:"cache_keep_tags"`
+	CacheMaxBytes            int64             `mapstructure:"cache_max_bytes"`
+	Assets                   []*AssetConfig    `mapstructure:"assets" validate:"dive"`
+	ReuploadPolicy           string            `mapstructure:"reupload_policy" validate:"omitempty,oneof=alert canary"`
+	MinReleaseAge            time.Duration     `mapstructure:"min_release_age"`
+	DeploymentEnvironment    string            `mapstructure:"deployment_environment"`
+	HostLabels               map[string]string `mapstructure:"host_labels"`
 }
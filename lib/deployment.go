@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-github/v55/github"
+)
+
+const (
+	DeploymentInProgress = "in_progress"
+	DeploymentSuccess    = "success"
+	DeploymentFailure    = "failure"
+	DeploymentError      = "error"
+)
+
+// the reports are dropped when the queue is full
+const deploymentQueueSize = 64
+
+// max length of the description of a deployment status
+const deploymentDescriptionLength = 140
+
+// DeploymentReporter reports the canary release and the rollout to the GitHub Deployments API.
+// Reports are best-effort: they are sent in order by a goroutine and the failures are only logged,
+// so that they never block the deploy.
+type DeploymentReporter struct {
+	client      *github.Client
+	owner       string
+	repo        string
+	environment string
+	config      *Config
+	state       *State
+	queue       chan func(ctx context.Context) error
+	done        chan struct{}
+}
+
+// NewDeploymentReporter returns nil when deployment_environment is not configured.
+// All the methods of the nil reporter do nothing.
+func NewDeploymentReporter(config *Config, state *State) (*DeploymentReporter, error) {
+	if config.DeploymentEnvironment == "" {
+		return nil, nil
+	}
+	if config.Source != "" && config.Source != SourceGitHub {
+		return nil, fmt.Errorf("deployment_environment requires source = %q", SourceGitHub)
+	}
+
+	client, owner, repo, err := newGitHubClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &DeploymentReporter{
+		client:      client,
+		owner:       owner,
+		repo:        repo,
+		environment: config.DeploymentEnvironment,
+		config:      config,
+		state:       state,
+		queue:       make(chan func(ctx context.Context) error, deploymentQueueSize),
+		done:        make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *DeploymentReporter) run() {
+	defer close(r.done)
+
+	timeout := r.config.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	for f := range r.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := f(ctx); err != nil {
+			slog.Warn("can't report github deployment", "environment", r.environment, "err", err)
+		}
+		cancel()
+	}
+}
+
+func (r *DeploymentReporter) enqueue(f func(ctx context.Context) error) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.queue <- f:
+	default:
+		slog.Warn("github deployment report queue is full, drop the report", "environment", r.environment)
+	}
+}
+
+// Close sends the queued reports until ctx is done
+func (r *DeploymentReporter) Close(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	close(r.queue)
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		slog.Warn("github deployment reports are not sent", "environment", r.environment, "err", ctx.Err())
+	}
+}
+
+// Start creates the deployment of the commit of the tag when the canary release starts
+func (r *DeploymentReporter) Start(tag, description string) {
+	r.enqueue(func(ctx context.Context) error {
+		d, _, err := r.client.Repositories.CreateDeployment(ctx, r.owner, r.repo, &github.DeploymentRequest{
+			Ref:         github.String(tag),
+			Environment: github.String(r.environment),
+			Description: github.String(truncateDescription(description)),
+			AutoMerge:   github.Bool(false),
+			// the deployment is created regardless of the commit statuses
+			RequiredContexts: &[]string{},
+		})
+		if err != nil {
+			return fmt.Errorf("can't create deployment of tag:%s %w", tag, err)
+		}
+		if err := r.state.SaveDeployment(tag, d.GetID()); err != nil {
+			return err
+		}
+		slog.Info("github deployment created", "tag", tag, "environment", r.environment, "id", d.GetID())
+		return r.createStatus(ctx, d.GetID(), DeploymentInProgress, description)
+	})
+}
+
+// Update reports the status to the deployment of the tag created by Start
+func (r *DeploymentReporter) Update(tag, status, description string) {
+	r.enqueue(func(ctx context.Context) error {
+		id, err := r.state.DeploymentID(tag)
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			slog.Debug("github deployment of the tag is not found", "tag", tag)
+			return nil
+		}
+		return r.createStatus(ctx, id, status, description)
+	})
+}
+
+// Progress reports the rollout progress, the deployment succeeds when all the members installed the tag
+func (r *DeploymentReporter) Progress(tag string, installed, all int) {
+	if installed >= all {
+		r.Update(tag, DeploymentSuccess, fmt.Sprintf("rolled out to %d/%d members", installed, all))
+		return
+	}
+	r.Update(tag, DeploymentInProgress, fmt.Sprintf("rolling out %d/%d members", installed, all))
+}
+
+func (r *DeploymentReporter) createStatus(ctx context.Context, id int64, status, description string) error {
+	_, _, err := r.client.Repositories.CreateDeploymentStatus(ctx, r.owner, r.repo, id, &github.DeploymentStatusRequest{
+		State:       github.String(status),
+		Description: github.String(truncateDescription(description)),
+		Environment: github.String(r.environment),
+	})
+	if err != nil {
+		return fmt.Errorf("can't create deployment status:%s of deployment:%d %w", status, id, err)
+	}
+	slog.Debug("github deployment status created", "id", id, "status", status, "description", description)
+	return nil
+}
+
+func truncateDescription(s string) string {
+	r := []rune(s)
+	if len(r) <= deploymentDescriptionLength {
+		return s
+	}
+	return string(r[:deploymentDescriptionLength-3]) + "..."
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/testutils"
+	"github.com/tj/assert"
+)
+
+func TestDeploymentReporter(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	assert.NoError(t, redisClient.FlushAll(context.Background()).Err())
+
+	f := &fakeGitHub{}
+	srv := f.serve(t)
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_TOKEN", "dummy")
+
+	config := newTestConfig()
+	config.Repo = "foo/bar"
+	config.DeploymentEnvironment = "production"
+	state, err := NewState(config)
+	assert.NoError(t, err)
+
+	r, err := NewDeploymentReporter(config, state)
+	assert.NoError(t, err)
+
+	r.Start("v1.0.0", "canary release on host1")
+	r.Progress("v1.0.0", 1, 3)
+	r.Progress("v1.0.0", 3, 3)
+	// no deployment is created for the tag
+	r.Update("v0.9.0", DeploymentFailure, "unknown")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.Close(ctx)
+
+	assert.Equal(t, 1, len(f.deployments))
+	assert.Equal(t, "v1.0.0", f.deployments[0]["ref"])
+	assert.Equal(t, "production", f.deployments[0]["environment"])
+	assert.Equal(t, []interface{}{}, f.deployments[0]["required_contexts"])
+
+	states := []string{}
+	for _, st := range f.deploymentStatuses {
+		assert.Equal(t, 1, st["deployment_id"])
+		states = append(states, st["state"].(string))
+	}
+	assert.Equal(t, []string{DeploymentInProgress, DeploymentInProgress, DeploymentSuccess}, states)
+	assert.Equal(t, "rolled out to 3/3 members", f.deploymentStatuses[2]["description"])
+
+	id, err := state.DeploymentID("v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), id)
+
+	// the failures of the API are only logged
+	f.failDeployments = true
+	r, err = NewDeploymentReporter(config, state)
+	assert.NoError(t, err)
+	r.Start("v1.1.0", "canary release on host1")
+	r.Update("v1.1.0", DeploymentFailure, "canary failed health check")
+	r.Close(ctx)
+	assert.Equal(t, 1, len(f.deployments))
+	assert.Equal(t, 3, len(f.deploymentStatuses))
+
+	// nil reporter does nothing
+	config.DeploymentEnvironment = ""
+	r, err = NewDeploymentReporter(config, state)
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+	r.Start("v1.0.0", "")
+	r.Close(ctx)
+
+	config.DeploymentEnvironment = "production"
+	config.Source = SourceGitLab
+	_, err = NewDeploymentReporter(config, state)
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"bufio"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrReleaseSkipped = errors.New("release skipped by directive")
+
+// Directives steer the rollout of a release from a fenced gacr block in the release notes.
+//
+//	```gacr
+//	skip: false
+//	canary_window: 30m
+//	healthcheck_command: /usr/local/bin/check-migration
+//	requires_manual_promotion: true
+//	```
+type Directives struct {
+	Skip                    bool          `json:"skip,omitempty"`
+	CanaryWindow            time.Duration `json:"canary_window,omitempty"`
+	HealthCheckCommand      string        `json:"healthcheck_command,omitempty"`
+	RequiresManualPromotion bool          `json:"requires_manual_promotion,omitempty"`
+}
+
+// parseDirectives parses the gacr blocks in the release body. Unknown keys and invalid values are ignored with a warning.
+func parseDirectives(tag, body string) *Directives {
+	d := &Directives{}
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !inBlock {
+			inBlock = line == "```gacr"
+			continue
+		}
+		if line == "```" {
+			inBlock = false
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			slog.Warn("invalid release directive", "tag", tag, "line", line)
+			continue
+		}
+		k = strings.TrimSpace(k)
+		v = strings.Trim(strings.TrimSpace(v), `"'`)
+
+		var err error
+		switch k {
+		case "skip":
+			d.Skip, err = strconv.ParseBool(v)
+		case "canary_window":
+			d.CanaryWindow, err = time.ParseDuration(v)
+		case "healthcheck_command":
+			d.HealthCheckCommand = v
+		case "requires_manual_promotion":
+			d.RequiresManualPromotion, err = strconv.ParseBool(v)
+		default:
+			slog.Warn("unknown release directive", "tag", tag, "key", k)
+		}
+		if err != nil {
+			slog.Warn("invalid release directive", "tag", tag, "key", k, "err", err)
+		}
+	}
+	return d
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestParseDirectives(t *testing.T) {
+	testCases := []struct {
+		name string
+		body string
+		want *Directives
+	}{
+		{
+			name: "no directives",
+			body: "## Changes\n- fix bug\n",
+			want: &Directives{},
+		},
+		{
+			name: "all directives",
+			body: "## Changes\n\n```gacr\nskip: false\ncanary_window: 30m\nhealthcheck_command: \"/usr/local/bin/check --strict\"\nrequires_manual_promotion: true\n```\n",
+			want: &Directives{
+				CanaryWindow:            30 * time.Minute,
+				HealthCheckCommand:      "/usr/local/bin/check --strict",
+				RequiresManualPromotion: true,
+			},
+		},
+		{
+			name: "unknown keys and invalid values are ignored",
+			body: "```gacr\nskip: true\nunknown: 1\ncanary_window: soon\n```\n```sh\nrequires_manual_promotion: true\n```",
+			want: &Directives{Skip: true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseDirectives("v1.0.0", tc.body))
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// suffix of the file being downloaded, it is renamed to the asset name on completion
+const partialSuffix = ".part"
+
+// rangeGet sends the request with a Range header when offset is given.
+// It returns the offset the body starts from, 0 when the server ignored the range.
+func rangeGet(client *http.Client, req *http.Request, offset int64) (io.ReadCloser, int64, error) {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return res.Body, offset, nil
+	case http.StatusOK:
+		return res.Body, 0, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		res.Body.Close()
+		// the partial file is broken, retry from the beginning
+		req.Header.Del("Range")
+		return rangeGet(client, req, 0)
+	}
+	res.Body.Close()
+	return nil, 0, statusError("GET", req.URL.String(), res.StatusCode)
+}
+
+// validCachedAsset reports whether the file at filePath is a completely downloaded asset of the tag
+// and it is not replaced under the same tag since it was downloaded
+func (d *assetDownloader) validCachedAsset(tag string, asset *releaseAsset, filePath string) (bool, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if asset.size > 0 && fi.Size() != asset.size {
+		slog.Warn("cached asset size mismatch, download again", "path", filePath, "expected", asset.size, "actual", fi.Size())
+		if err := os.Remove(filePath); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	entry, err := d.cache.find(tag, asset.name)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil {
+		// the file is left by an interrupted download or an index which can't be updated
+		slog.Info("asset of the tag is not cached, download again", "path", filePath, "tag", tag)
+		return false, nil
+	}
+	if entry.reuploaded(asset) {
+		slog.Warn("asset is re-uploaded under the same tag, download again", "tag", tag, "asset", asset.name, "id", asset.id, "updated_at", asset.updatedAt)
+		if err := os.Remove(filePath); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// downloadAsset downloads to a partial file and renames it after fsync, so that
+// an interrupted download never leaves a truncated asset at filePath.
+// The partial file is resumed by a range request at the retry or the next download of the tag,
+// it is placed in the directory of the tag so that the asset of another tag with the same name never resumes it.
+func (d *assetDownloader) downloadAsset(ctx context.Context, asset *releaseAsset, filePath string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.downloadTimeout())
+	defer cancel()
+
+	err := d.withRetry(ctx, 0, func(ctx context.Context) error {
+		return d.downloadPartial(ctx, asset, filePath)
+	})
+	if err != nil && !errors.Is(err, ErrAssetsCannotDownload) {
+		return wrapSourceError(err, fmt.Sprintf("asset:%s", asset.name))
+	}
+	return err
+}
+
+func (d *assetDownloader) downloadPartial(ctx context.Context, asset *releaseAsset, filePath string) error {
+	partPath := filePath + partialSuffix
+
+	var offset int64
+	if fi, err := os.Stat(partPath); err == nil {
+		offset = fi.Size()
+		if asset.size > 0 && offset >= asset.size {
+			offset = 0
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	ret, offset, err := d.backend.openAsset(ctx, asset, offset)
+	if err != nil {
+		return err
+	}
+	defer ret.Close()
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	} else {
+		slog.Info("resume asset download", "asset", asset.name, "offset", offset)
+	}
+
+	out, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, ret)
+	if err != nil {
+		return err
+	}
+
+	if asset.size > 0 && offset+n != asset.size {
+		if err := os.Remove(partPath); err != nil {
+			slog.Warn("can't remove partial asset", "path", partPath, "err", err)
+		}
+		return errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("asset:%s size mismatch expected:%d actual:%d", asset.name, asset.size, offset+n))
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(partPath, filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// syncDir persists the rename in the directory
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
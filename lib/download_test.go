@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/tj/assert"
+)
+
+func TestDownloadReleaseAssetAtomic(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	root := t.TempDir()
+	writeMirrorFile(t, root, "v1.0.0", "app_1.0.0_amd64.deb", content)
+
+	testCases := []struct {
+		name      string
+		size      int
+		partial   string
+		cached    string
+		wantRange string
+		wantErr   error
+	}{
+		{
+			name: "download",
+			size: len(content),
+		},
+		{
+			name:      "resume partial download",
+			size:      len(content),
+			partial:   content[:300],
+			wantRange: "bytes=300-",
+		},
+		{
+			name:   "truncated cache",
+			size:   len(content),
+			cached: content[:10],
+		},
+		{
+			name:    "size mismatch",
+			size:    len(content) + 1,
+			wantErr: ErrAssetsCannotDownload,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writeMirrorFile(t, root, "", mirrorIndex, fmt.Sprintf(`[
+  {"tag":"v1.0.0","published_at":"2024-01-01T00:00:00Z","assets":[{"name":"app_1.0.0_amd64.deb","size":%d}]}
+]`, tc.size))
+
+			gotRange := ""
+			fs := http.FileServer(http.Dir(root))
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, ".deb") {
+					gotRange = r.Header.Get("Range")
+				}
+				fs.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			config := &Config{
+				Source:             SourceMirror,
+				MirrorURL:          srv.URL,
+				SaveAssetsPath:     t.TempDir(),
+				PackageNamePattern: `.*\.deb$`,
+			}
+			filePath := filepath.Join(config.SaveAssetsPath, "v1.0.0", "app_1.0.0_amd64.deb")
+			assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+			if tc.partial != "" {
+				assert.NoError(t, os.WriteFile(filePath+partialSuffix, []byte(tc.partial), 0644))
+			}
+			if tc.cached != "" {
+				assert.NoError(t, os.WriteFile(filePath, []byte(tc.cached), 0644))
+			}
+
+			source, err := NewReleaseSource(config)
+			assert.NoError(t, err)
+
+			_, file, err := source.DownloadReleaseAsset(context.Background(), "v1.0.0")
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+				_, err := os.Stat(filePath)
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, filePath, file)
+			assert.Equal(t, tc.wantRange, gotRange)
+
+			b, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(b))
+
+			_, err = os.Stat(filePath + partialSuffix)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestDownloadReleaseAssetSameNameAcrossTags(t *testing.T) {
+	root := t.TempDir()
+	writeMirrorFile(t, root, "v1.0.0", "app.deb", "content of v1.0.0")
+	writeMirrorFile(t, root, "v1.1.0", "app.deb", "content of v1.1.0")
+	writeMirrorFile(t, root, "", mirrorIndex, `[
+  {"tag":"v1.0.0","published_at":"2024-01-01T00:00:00Z","assets":[{"name":"app.deb","size":17}]},
+  {"tag":"v1.1.0","published_at":"2024-02-01T00:00:00Z","assets":[{"name":"app.deb","size":17}]}
+]`)
+	srv := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer srv.Close()
+
+	config := &Config{
+		Source:             SourceMirror,
+		MirrorURL:          srv.URL,
+		SaveAssetsPath:     t.TempDir(),
+		PackageNamePattern: `.*\.deb$`,
+	}
+	source, err := NewReleaseSource(config)
+	assert.NoError(t, err)
+
+	// the interrupted download of v1.0.0 is resumed only for v1.0.0
+	partial := filepath.Join(config.SaveAssetsPath, "v1.0.0", "app.deb"+partialSuffix)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(partial), 0755))
+	assert.NoError(t, os.WriteFile(partial, []byte("content of v1.0"), 0644))
+
+	for _, tag := range []string{"v1.1.0", "v1.0.0", "v1.1.0"} {
+		_, file, err := source.DownloadReleaseAsset(context.Background(), tag)
+		assert.NoError(t, err)
+		b, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, "content of "+tag, string(b))
+	}
+}
+
+func TestResolveReleaseReadsChecksumsOnDownload(t *testing.T) {
+	root := t.TempDir()
+	content := "content of v1.0.0"
+	writeMirrorFile(t, root, "v1.0.0", "app.deb", content)
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+	writeMirrorFile(t, root, "v1.0.0", "SHA256SUMS", digest+"  app.deb\n")
+	writeMirrorFile(t, root, "", mirrorIndex, `[
+  {"tag":"v1.0.0","published_at":"2024-01-01T00:00:00Z","assets":[{"name":"app.deb"},{"name":"SHA256SUMS"}]}
+]`)
+
+	sumsRequests := 0
+	fs := http.FileServer(http.Dir(root))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "SHA256SUMS") {
+			sumsRequests++
+		}
+		fs.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	source, err := NewReleaseSource(&Config{
+		Source:             SourceMirror,
+		MirrorURL:          srv.URL,
+		SaveAssetsPath:     t.TempDir(),
+		PackageNamePattern: `\.deb$`,
+		ChecksumPattern:    `^SHA256SUMS$`,
+	})
+	assert.NoError(t, err)
+
+	// polling doesn't read the checksums
+	for i := 0; i < 3; i++ {
+		info, err := source.ResolveRelease(context.Background(), LatestTag)
+		assert.NoError(t, err)
+		assert.Empty(t, info.Digest)
+	}
+	assert.Equal(t, 0, sumsRequests)
+
+	_, _, err = source.DownloadReleaseAsset(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sumsRequests)
+
+	// the digest of the cached asset is verified by the checksums
+	info, err := source.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, info.Digest)
+	assert.Equal(t, 1, sumsRequests)
+}
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsupportedArchive = errors.New("unsupported archive")
+
+// extractArchive extracts .tar.gz/.tgz/.zip into dest.
+// Entries escaping dest(absolute path, "..", symlinks) and entries written through a symlink are refused.
+func extractArchive(src, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	name := strings.ToLower(src)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return extractTarGz(src, dest)
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip(src, dest)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedArchive, filepath.Base(src))
+}
+
+// extractPath returns the path of the entry under dest.
+// The name is checked as text, checkNoSymlink checks the directories on the filesystem.
+func extractPath(dest, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("archive entry has absolute path: %s", name)
+	}
+
+	p := filepath.Join(dest, name)
+	rel, err := filepath.Rel(dest, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry escapes the destination: %s", name)
+	}
+	return p, nil
+}
+
+// checkNoSymlink refuses dir when it or a directory between dest and it is a symlink.
+// A symlink extracted before can lead an entry outside dest however safe its target looks.
+func checkNoSymlink(dest, dir string) error {
+	rel, err := filepath.Rel(dest, dir)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	p := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry is written through symlink: %s", rel)
+		}
+	}
+	return nil
+}
+
+func writeExtractedFile(p string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// don't follow a symlink placed by the previous extraction
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func extractTarGz(src, dest string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p, err := extractPath(dest, h.Name)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(p)
+		if h.Typeflag == tar.TypeDir {
+			dir = p
+		}
+		if err := checkNoSymlink(dest, dir); err != nil {
+			return err
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtractedFile(p, tr, h.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := h.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(h.Name), target)
+			}
+			if _, err := extractPath(dest, target); err != nil {
+				return fmt.Errorf("symlink %s: %s", h.Name, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(h.Linkname, p); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry type %c: %s", h.Typeflag, h.Name)
+		}
+	}
+}
+
+func extractZip(src, dest string) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		p, err := extractPath(dest, zf.Name)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(p)
+		if zf.FileInfo().IsDir() {
+			dir = p
+		}
+		if err := checkNoSymlink(dest, dir); err != nil {
+			return err
+		}
+
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			return fmt.Errorf("unsupported archive entry: %s", zf.Name)
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtractedFile(p, r, zf.Mode())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
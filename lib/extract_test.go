@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+type archiveEntry struct {
+	name     string
+	body     string
+	linkname string
+}
+
+func tarGz(t *testing.T, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.linkname != "" {
+			h = &tar.Header{Name: e.name, Linkname: e.linkname, Typeflag: tar.TypeSymlink}
+		}
+		assert.NoError(t, tw.WriteHeader(h))
+		_, err := tw.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		archive  func(t *testing.T) []byte
+		wantFile string
+		wantErr  bool
+	}{
+		{
+			name: "tar.gz",
+			file: "conf.tar.gz",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t, archiveEntry{name: "etc/app.conf", body: "conf"}, archiveEntry{name: "etc/link.conf", linkname: "app.conf"})
+			},
+			wantFile: "etc/app.conf",
+		},
+		{
+			name: "zip",
+			file: "conf.zip",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, archiveEntry{name: "etc/app.conf", body: "conf"})
+			},
+			wantFile: "etc/app.conf",
+		},
+		{
+			name: "tar.gz path traversal",
+			file: "evil.tar.gz",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t, archiveEntry{name: "../evil", body: "evil"})
+			},
+			wantErr: true,
+		},
+		{
+			name: "tar.gz symlink escape",
+			file: "evil.tgz",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t, archiveEntry{name: "evil", linkname: "../../evil"})
+			},
+			wantErr: true,
+		},
+		{
+			name: "tar.gz chained symlinks escape",
+			file: "evil.tgz",
+			archive: func(t *testing.T) []byte {
+				// each target looks inside the destination, but d resolves to the parent of it
+				return tarGz(t,
+					archiveEntry{name: "c", linkname: "."},
+					archiveEntry{name: "d", linkname: "c/.."},
+					archiveEntry{name: "d/evil", body: "evil"},
+				)
+			},
+			wantErr: true,
+		},
+		{
+			name: "zip path traversal",
+			file: "evil.zip",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, archiveEntry{name: "../evil", body: "evil"})
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, tc.file)
+			assert.NoError(t, os.WriteFile(src, tc.archive(t), 0644))
+			dest := filepath.Join(dir, "out")
+
+			err := extractArchive(src, dest)
+			if tc.wantErr {
+				assert.Error(t, err)
+				_, err := os.Stat(filepath.Join(dir, "evil"))
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			assert.NoError(t, err)
+			b, err := os.ReadFile(filepath.Join(dest, tc.wantFile))
+			assert.NoError(t, err)
+			assert.Equal(t, "conf", string(b))
+		})
+	}
+}
+
+func TestDownloadMultipleAssets(t *testing.T) {
+	root := t.TempDir()
+	writeMirrorFile(t, root, "v1.0.0", "app_1.0.0_amd64.tar.gz", string(tarGz(t, archiveEntry{name: "bin/app", body: "app"})))
+	writeMirrorFile(t, root, "v1.0.0", "config_1.0.0.zip", string(zipArchive(t, archiveEntry{name: "etc/app.conf", body: "conf"})))
+
+	config := &Config{
+		Source:         SourceMirror,
+		MirrorURL:      root,
+		SaveAssetsPath: t.TempDir(),
+		Assets: []*AssetConfig{
+			{Name: "bin", Pattern: `^app_.*\.tar\.gz$`, Extract: true},
+			{Name: "config-bundle", Pattern: `^config_.*\.zip$`, Extract: true},
+		},
+	}
+	source, err := NewReleaseSource(config)
+	assert.NoError(t, err)
+
+	tag, file, err := source.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	assert.Equal(t, filepath.Join(config.SaveAssetsPath, "v1.0.0", "app_1.0.0_amd64.tar.gz"), file)
+
+	dir := filepath.Join(config.SaveAssetsPath, "v1.0.0", "extracted")
+	assert.ElementsMatch(t, []string{
+		"ASSET_FILE_BIN=" + file,
+		"ASSET_FILE_CONFIG_BUNDLE=" + filepath.Join(config.SaveAssetsPath, "v1.0.0", "config_1.0.0.zip"),
+		"ASSET_DIR=" + dir,
+	}, AssetEnv(tag, file))
+
+	for name, want := range map[string]string{"bin/app": "app", "etc/app.conf": "conf"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(b))
+	}
+
+	cached, err := NewAssetCache(config.SaveAssetsPath).Lookup(tag)
+	assert.NoError(t, err)
+	assert.Equal(t, file, cached.Path)
+}
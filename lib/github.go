@@ -6,177 +6,208 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
-	"regexp"
+	"net/url"
 	"strings"
 
-	"github.com/pkg/errors"
-
 	"github.com/google/go-github/v55/github"
 	"github.com/k1LoW/go-github-client/v55/factory"
 )
 
 type GitHub struct {
-	client                *github.Client
-	config                *Config
-	owner                 string
-	repo                  string
-	regPackageNamePattern *regexp.Regexp
-	lastTag               string
-	lastAssetFile         string
-}
-
-type GitHuber interface {
-	DownloadReleaseAsset(tag string) (string, string, error)
+	*assetDownloader
+	client *github.Client
+	owner  string
+	repo   string
 }
 
 func NewGitHub(config *Config) (*GitHub, error) {
-	token := config.GitHubToken
-	if os.Getenv("GITHUB_TOKEN") == "" {
-		os.Setenv("GITHUB_TOKEN", token)
+	client, owner, repo, err := newGitHubClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GitHub{
+		client: client,
+		owner:  owner,
+		repo:   repo,
+	}
+
+	d, err := newAssetDownloader(config, g)
+	if err != nil {
+		return nil, err
 	}
+	g.assetDownloader = d
+	return g, nil
+}
 
-	client, _ := factory.NewGithubClient()
+// newGitHubClient returns the API client authenticated by the token or the GitHub App and the owner and the name of the repo
+func newGitHubClient(config *Config) (*github.Client, string, string, error) {
 	ownerRepo := strings.Split(config.Repo, "/")
 	if len(ownerRepo) != 2 {
-		return nil, fmt.Errorf("invalid repo: %s", config.Repo)
-	}
-	return &GitHub{
-		client:                client,
-		config:                config,
-		owner:                 ownerRepo[0],
-		repo:                  ownerRepo[1],
-		regPackageNamePattern: regexp.MustCompile(config.PackageNamePattern),
-	}, nil
-}
+		return nil, "", "", fmt.Errorf("invalid repo: %s", config.Repo)
+	}
 
-var ErrAssetsNotFound = errors.New("no match assets")
+	// GITHUB_API_URL, GH_HOST and the gh cli configuration are used unless the endpoint is configured
+	token, endpoint, uploadURL, _ := factory.GetTokenAndEndpoints()
+	if token == "" {
+		token = config.GitHubToken
+	}
+	if config.GitHubAPIEndpoint != "" {
+		endpoint = config.GitHubAPIEndpoint
+		uploadURL = githubUploadURL(endpoint)
+	}
+	if config.GitHubUploadURL != "" {
+		uploadURL = config.GitHubUploadURL
+	}
 
-const LatestTag = "latest"
+	baseURL, err := githubURL(endpoint)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("invalid github api endpoint: %s", err)
+	}
+	upload, err := githubURL(uploadURL)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("invalid github upload url: %s", err)
+	}
 
-func (g *GitHub) searchReleaseWithPreRelease(owner, repo string) (*github.RepositoryRelease, error) {
-	var allReleases []*github.RepositoryRelease
-	opts := &github.ListOptions{Page: 1, PerPage: 100}
+	base, err := newHTTPTransport(config)
+	if err != nil {
+		return nil, "", "", err
+	}
 
-	for {
-		releases, resp, err := g.client.Repositories.ListReleases(context.Background(), owner, repo, opts)
+	var tr http.RoundTripper
+	if config.GitHubAppID != 0 {
+		atr, err := newGitHubAppTransport(config, base, endpoint, ownerRepo[0], ownerRepo[1])
 		if err != nil {
-			return nil, err
+			return nil, "", "", err
 		}
+		slog.Info("authenticate as github app", "app_id", config.GitHubAppID, "installation_id", atr.itr.InstallationID())
+		tr = atr
+	} else if token != "" {
+		tr = &githubTokenTransport{base: base, token: token, apiHost: baseURL.Host}
+	} else {
+		slog.Warn("github client without authentication", "endpoint", endpoint)
+		tr = base
+	}
 
-		allReleases = append(allReleases, releases...)
+	// the rate limit aware transport caches API responses by ETag
+	// requests are bounded by the context instead of the client timeout, so that large assets can be downloaded
+	client := github.NewClient(&http.Client{Transport: newRateLimitTransport(tr)})
+	client.BaseURL = baseURL
+	client.UploadURL = upload
+	return client, ownerRepo[0], ownerRepo[1], nil
+}
 
-		if resp.NextPage == 0 {
-			break
-		}
-		opts.Page = resp.NextPage
+// githubUploadURL returns the upload url of the api endpoint, GitHub Enterprise Server serves it under /api/uploads
+func githubUploadURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || strings.HasSuffix(u.Host, "github.com") {
+		return "https://uploads.github.com/"
 	}
+	return fmt.Sprintf("%s://%s/api/uploads/", u.Scheme, u.Host)
+}
 
-	// sort by published date desc
-	for i := 0; i < len(allReleases); i++ {
-		for j := i + 1; j < len(allReleases); j++ {
-			if allReleases[i].PublishedAt.Before(allReleases[j].PublishedAt.Time) {
-				allReleases[i], allReleases[j] = allReleases[j], allReleases[i]
-			}
-		}
+func githubURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%s is not an absolute url", s)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
 	}
+	return u, nil
+}
 
-	for _, r := range allReleases {
-		if r.GetDraft() {
-			continue
-		}
-		if r.GetPrerelease() {
-			return r, nil
-		}
+// githubTokenTransport sends the token only to the API(not to redirected asset storage)
+type githubTokenTransport struct {
+	base    http.RoundTripper
+	token   string
+	apiHost string
+}
+
+func (t *githubTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.apiHost {
+		return t.base.RoundTrip(req)
 	}
-	return nil, ErrAssetsNotFound
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token "+t.token)
+	return t.base.RoundTrip(req)
 }
 
-var ErrAssetsCannotDownload = errors.New("assets cannot download")
+func newGitHubRelease(r *github.RepositoryRelease) *release {
+	ret := &release{
+		tag:         r.GetTagName(),
+		draft:       r.GetDraft(),
+		prerelease:  r.GetPrerelease(),
+		publishedAt: r.GetPublishedAt().Time,
+		body:        r.GetBody(),
+	}
+	for _, a := range r.Assets {
+		ret.assets = append(ret.assets, &releaseAsset{
+			id:        a.GetID(),
+			name:      a.GetName(),
+			size:      int64(a.GetSize()),
+			url:       a.GetURL(),
+			updatedAt: a.GetUpdatedAt().Time,
+		})
+	}
+	return ret
+}
 
-func (g *GitHub) DownloadReleaseAsset(tag string) (string, string, error) {
-	var release *github.RepositoryRelease
+func (g *GitHub) latestRelease(ctx context.Context) (*release, error) {
+	r, _, err := g.client.Repositories.GetLatestRelease(ctx, g.owner, g.repo)
+	if err != nil {
+		return nil, err
+	}
+	return newGitHubRelease(r), nil
+}
 
-	if tag != "" && tag == g.lastTag && g.lastAssetFile != "" {
-		return tag, g.lastAssetFile, nil
+func (g *GitHub) releaseByTag(ctx context.Context, tag string) (*release, error) {
+	r, _, err := g.client.Repositories.GetReleaseByTag(ctx, g.owner, g.repo, tag)
+	if err != nil {
+		return nil, err
 	}
-	if tag == LatestTag {
-		r, _, err := g.client.Repositories.GetLatestRelease(context.Background(), g.owner, g.repo)
+	return newGitHubRelease(r), nil
+}
+
+func (g *GitHub) listReleases(ctx context.Context) ([]*release, error) {
+	var allReleases []*release
+	opts := &github.ListOptions{Page: 1, PerPage: 100}
+
+	for {
+		releases, resp, err := g.client.Repositories.ListReleases(ctx, g.owner, g.repo, opts)
 		if err != nil {
-			if !g.config.IncludePreRelease {
-				return "", "", errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", tag, err))
-			}
+			return nil, err
 		}
 
-		release = r
-		if g.config.IncludePreRelease {
-			inPrerelease, err := g.searchReleaseWithPreRelease(g.owner, g.repo)
-			if err != nil {
-				if err != ErrAssetsNotFound {
-					return "", "", fmt.Errorf("repositories.ListReleases returned error: %v", err)
-				}
-			}
-
-			// プレリリースが最新の場合はプレリリースを返す
-			if inPrerelease != nil && (r == nil || inPrerelease.PublishedAt.After(r.PublishedAt.Time)) {
-				release = inPrerelease
-			}
-		}
-	} else {
-		r, _, err := g.client.Repositories.GetReleaseByTag(context.Background(), g.owner, g.repo, tag)
-		if err != nil {
-			return "", "", errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", tag, err))
+		for _, r := range releases {
+			allReleases = append(allReleases, newGitHubRelease(r))
 		}
-		release = r
-	}
-
-	slog.Debug("tag info", "latest release Tag", *release.TagName)
-	for _, asset := range release.Assets {
-		slog.Debug("assets info", "name", *asset.Name, "download url", *asset.URL)
-		if g.regPackageNamePattern.MatchString(*asset.Name) {
-			filePath := filepath.Join(g.config.SaveAssetsPath, *asset.Name)
-
-			if _, err := os.Stat(filePath); err == nil {
-				return *release.TagName, filePath, nil
-			} else if !os.IsNotExist(err) {
-				return "", "", err
-			}
-
-			ret, loc, err := g.client.Repositories.DownloadReleaseAsset(context.Background(), g.owner, g.repo, *asset.ID, nil)
-			if err != nil {
-				return "", "", fmt.Errorf("repositories.DownloadReleaseAsset returned error: %v", err)
-			}
-
-			if loc != "" {
-				req, err := http.NewRequestWithContext(context.Background(), "GET", loc, nil)
-				if err != nil {
-					return "", "", err
-				}
-				res, err := g.client.Client().Do(req)
-				if err != nil {
-					return "", "", err
-				}
-				ret = res.Body
-				if ret != nil {
-					defer ret.Close()
-				}
-			}
-
-			out, err := os.Create(filePath)
-			if err != nil {
-				return "", "", err
-			}
-			defer out.Close()
-			_, err = io.Copy(out, ret)
-			if err != nil {
-				return "", "", err
-			}
-			g.lastTag = *release.TagName
-			g.lastAssetFile = filePath
-
-			return *release.TagName, filePath, nil
+
+		if resp.NextPage == 0 {
+			break
 		}
+		opts.Page = resp.NextPage
+	}
+	return allReleases, nil
+}
+
+func (g *GitHub) openAsset(ctx context.Context, asset *releaseAsset, offset int64) (io.ReadCloser, int64, error) {
+	ret, loc, err := g.client.Repositories.DownloadReleaseAsset(ctx, g.owner, g.repo, asset.id, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repositories.DownloadReleaseAsset returned error: %w", err)
+	}
+
+	// the asset is served without redirect, it can't be resumed
+	if loc == "" {
+		return ret, 0, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", loc, nil)
+	if err != nil {
+		return nil, 0, err
 	}
-	return "", "", ErrAssetsNotFound
+	return rangeGet(g.client.Client(), req, offset)
 }
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/google/go-github/v55/github"
+)
+
+// githubAppTransport authenticates API requests as a GitHub App installation.
+// The installation token is minted and refreshed by ghinstallation before it expires.
+type githubAppTransport struct {
+	itr       *ghinstallation.Transport
+	base      http.RoundTripper
+	apiHost   string
+	mu        sync.Mutex
+	expiresAt time.Time
+}
+
+func newGitHubAppTransport(config *Config, base http.RoundTripper, endpoint, owner, repo string) (*githubAppTransport, error) {
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github api endpoint: %s", err)
+	}
+
+	atr, err := ghinstallation.NewAppsTransportKeyFromFile(base, config.GitHubAppID, config.GitHubAppPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load github app private key: %s", err)
+	}
+	atr.BaseURL = strings.TrimSuffix(endpoint, "/")
+
+	installationID := config.GitHubAppInstallationID
+	if installationID == 0 {
+		installationID, err = findInstallationID(atr, endpoint, owner, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find github app installation: %s", err)
+		}
+	}
+
+	return &githubAppTransport{
+		itr:     ghinstallation.NewFromAppsTransport(atr, installationID),
+		base:    base,
+		apiHost: ep.Host,
+	}, nil
+}
+
+func findInstallationID(atr *ghinstallation.AppsTransport, endpoint, owner, repo string) (int64, error) {
+	client := github.NewClient(&http.Client{Transport: atr, Timeout: 30 * time.Second})
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/")
+	if err != nil {
+		return 0, err
+	}
+	client.BaseURL = u
+
+	i, _, err := client.Apps.FindRepositoryInstallation(context.Background(), owner, repo)
+	if err != nil {
+		return 0, err
+	}
+	return i.GetID(), nil
+}
+
+func (t *githubAppTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the installation token is only sent to the API(not to redirected asset storage)
+	if req.URL.Host != t.apiHost {
+		return t.base.RoundTrip(req)
+	}
+
+	res, err := t.itr.RoundTrip(req)
+	if err != nil {
+		var herr *ghinstallation.HTTPError
+		if errors.As(err, &herr) {
+			slog.Warn("failed to refresh github app installation token", "installation_id", t.itr.InstallationID(), "err", err)
+		}
+		return nil, err
+	}
+	t.logRefresh()
+	return res, nil
+}
+
+func (t *githubAppTransport) logRefresh() {
+	expiresAt, _, err := t.itr.Expiry()
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !expiresAt.Equal(t.expiresAt) {
+		slog.Info("github app installation token refreshed", "app_id", t.itr.AppID(), "installation_id", t.itr.InstallationID(), "expires_at", expiresAt)
+		t.expiresAt = expiresAt
+	}
+}
@@ -0,0 +1,655 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aead.dev/minisign"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/pkg/errors"
+	"github.com/tj/assert"
+)
+
+type fakeAsset struct {
+	name    string
+	content []byte
+}
+
+type fakeRelease struct {
+	tag         string
+	prerelease  bool
+	publishedAt time.Time
+	assets      []fakeAsset
+}
+
+// fakeGitHub is a minimal stand-in for the GitHub releases API
+type fakeGitHub struct {
+	releases []fakeRelease
+	// installation token minted for the GitHub App, API requests must use it when set
+	installationToken string
+	tokenRequests     int
+	// GitHub Enterprise Server serves the API under /api/v3
+	prefix    string
+	tlsConfig *tls.Config
+	// assets are redirected to the storage which must not receive the token
+	redirect     bool
+	leakedTokens int
+	// requests to the deployments API
+	mu                 sync.Mutex
+	deployments        []map[string]interface{}
+	deploymentStatuses []map[string]interface{}
+	failDeployments    bool
+}
+
+func (f *fakeGitHub) assetID(r, a int) int {
+	return (r+1)*1000 + a
+}
+
+func (f *fakeGitHub) releaseJSON(serverURL string, i int) map[string]interface{} {
+	r := f.releases[i]
+	assets := []map[string]interface{}{}
+	for j, a := range r.assets {
+		assets = append(assets, map[string]interface{}{
+			"id":   f.assetID(i, j),
+			"name": a.name,
+			"size": len(a.content),
+			"url":  fmt.Sprintf("%s/repos/foo/bar/releases/assets/%d", serverURL, f.assetID(i, j)),
+		})
+	}
+	return map[string]interface{}{
+		"id":           i + 1,
+		"tag_name":     r.tag,
+		"prerelease":   r.prerelease,
+		"published_at": r.publishedAt.Format(time.RFC3339),
+		"assets":       assets,
+	}
+}
+
+func (f *fakeGitHub) serve(t *testing.T) *httptest.Server {
+	var srv, storage *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/foo/bar/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		latest := -1
+		for i, rel := range f.releases {
+			if rel.prerelease {
+				continue
+			}
+			if latest < 0 || rel.publishedAt.After(f.releases[latest].publishedAt) {
+				latest = i
+			}
+		}
+		if latest < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(f.releaseJSON(srv.URL+f.prefix, latest))
+	})
+	mux.HandleFunc("/repos/foo/bar/releases/tags/", func(w http.ResponseWriter, r *http.Request) {
+		tag := strings.TrimPrefix(r.URL.Path, "/repos/foo/bar/releases/tags/")
+		for i, rel := range f.releases {
+			if rel.tag == tag {
+				json.NewEncoder(w).Encode(f.releaseJSON(srv.URL+f.prefix, i))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/repos/foo/bar/releases", func(w http.ResponseWriter, r *http.Request) {
+		releases := []map[string]interface{}{}
+		for i := range f.releases {
+			releases = append(releases, f.releaseJSON(srv.URL+f.prefix, i))
+		}
+		json.NewEncoder(w).Encode(releases)
+	})
+	mux.HandleFunc("/repos/foo/bar/releases/assets/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/repos/foo/bar/releases/assets/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		for i, rel := range f.releases {
+			for j, a := range rel.assets {
+				if f.assetID(i, j) == id {
+					if f.redirect && r.Header.Get("X-Storage") == "" {
+						http.Redirect(w, r, fmt.Sprintf("%s/storage/%d", storage.URL, id), http.StatusFound)
+						return
+					}
+					w.Header().Set("Content-Type", "application/octet-stream")
+					w.Write(a.content)
+					return
+				}
+			}
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/repos/foo/bar/deployments", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.Method != http.MethodPost || f.failDeployments {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		d := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&d)
+		f.deployments = append(f.deployments, d)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": len(f.deployments)})
+	})
+	mux.HandleFunc("/repos/foo/bar/deployments/", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/foo/bar/deployments/"), "/statuses"))
+		if r.Method != http.MethodPost || err != nil || id > len(f.deployments) {
+			http.NotFound(w, r)
+			return
+		}
+		st := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&st)
+		st["deployment_id"] = id
+		f.deploymentStatuses = append(f.deploymentStatuses, st)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": len(f.deploymentStatuses)})
+	})
+	mux.HandleFunc("/repos/foo/bar/installation", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 99})
+	})
+	mux.HandleFunc("/app/installations/99/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		f.tokenRequests++
+		w.WriteHeader(http.StatusCreated)
+		// expires within the refresh window, so every API call refreshes it
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      f.installationToken,
+			"expires_at": time.Now().Add(30 * time.Second).Format(time.RFC3339),
+		})
+	})
+	// the storage is another host like the redirected asset storage of GitHub
+	storage = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			f.leakedTokens++
+		}
+		r.Header.Set("X-Storage", "1")
+		r.URL.Path = "/repos/foo/bar/releases/assets/" + strings.TrimPrefix(r.URL.Path, "/storage/")
+		mux.ServeHTTP(w, r)
+	}))
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, f.prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, f.prefix)
+		if f.installationToken != "" && strings.HasPrefix(r.URL.Path, "/repos/foo/bar/releases") &&
+			r.Header.Get("Authorization") != "token "+f.installationToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	if f.tlsConfig != nil {
+		srv.TLS = f.tlsConfig
+		srv.StartTLS()
+		storage.StartTLS()
+	} else {
+		srv.Start()
+		storage.Start()
+	}
+	t.Cleanup(srv.Close)
+	t.Cleanup(storage.Close)
+	return srv
+}
+
+func newTestGitHub(t *testing.T, f *fakeGitHub, config *Config) *GitHub {
+	srv := f.serve(t)
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_TOKEN", "dummy")
+
+	config.Repo = "foo/bar"
+	config.SaveAssetsPath = t.TempDir()
+	if config.PackageNamePattern == "" {
+		config.PackageNamePattern = `.*\.deb$`
+	}
+	g, err := NewGitHub(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	return g
+}
+
+func sha256sum(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+func TestDownloadReleaseAssetChecksum(t *testing.T) {
+	pkg := []byte("package body")
+	testCases := []struct {
+		name    string
+		assets  []fakeAsset
+		wantErr error
+	}{
+		{
+			name: "verified",
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "app_1.0.0_checksums.txt", content: []byte(sha256sum(pkg) + "  app_1.0.0_amd64.deb\n")},
+			},
+		},
+		{
+			name: "no checksums asset",
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+			},
+		},
+		{
+			name: "mismatch",
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "SHA256SUMS", content: []byte(sha256sum([]byte("tampered")) + " *app_1.0.0_amd64.deb\n")},
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "not listed",
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "SHA256SUMS", content: []byte(sha256sum(pkg) + "  other.deb\n")},
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeGitHub{
+				releases: []fakeRelease{
+					{tag: "v1.0.0", publishedAt: time.Now(), assets: tc.assets},
+				},
+			}
+			g := newTestGitHub(t, f, &Config{
+				ChecksumPattern: `(?i)(^sha256sums(\.txt)?$|checksums\.txt$)`,
+			})
+
+			tag, file, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+			assert.Equal(t, "v1.0.0", tag)
+			filePath := filepath.Join(g.config.SaveAssetsPath, "v1.0.0", "app_1.0.0_amd64.deb")
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+				_, err := os.Stat(filePath)
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, filePath, file)
+			b, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.Equal(t, pkg, b)
+		})
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	sums := parseChecksums([]byte(`
+# comment
+aaaa  gnu.deb
+bbbb *binary.deb
+SHA256 (bsd.deb) = CCCC
+`))
+	assert.Equal(t, map[string]string{
+		"gnu.deb":    "aaaa",
+		"binary.deb": "bbbb",
+		"bsd.deb":    "cccc",
+	}, sums)
+}
+
+func TestDownloadReleaseAssetSignature(t *testing.T) {
+	pkg := []byte("package body")
+
+	minisignPub, minisignPriv, err := minisign.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	minisignPubText, err := minisignPub.MarshalText()
+	assert.NoError(t, err)
+	_, otherPriv, err := minisign.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	prehashed := minisign.NewReader(bytes.NewReader(pkg))
+	_, err = io.Copy(io.Discard, prehashed)
+	assert.NoError(t, err)
+
+	entity, err := openpgp.NewEntity("gacr", "test", "gacr@example.com", nil)
+	assert.NoError(t, err)
+	var pgpPub bytes.Buffer
+	assert.NoError(t, entity.Serialize(&pgpPub))
+	var pgpSig bytes.Buffer
+	assert.NoError(t, openpgp.ArmoredDetachSign(&pgpSig, entity, bytes.NewReader(pkg), nil))
+
+	testCases := []struct {
+		name    string
+		keyring []byte
+		assets  []fakeAsset
+		wantErr error
+	}{
+		{
+			name:    "minisign",
+			keyring: minisignPubText,
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "app_1.0.0_amd64.deb.minisig", content: minisign.Sign(minisignPriv, pkg)},
+			},
+		},
+		{
+			name:    "minisign prehashed",
+			keyring: minisignPubText,
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "app_1.0.0_amd64.deb.minisig", content: prehashed.Sign(minisignPriv)},
+			},
+		},
+		{
+			name:    "minisign unknown key",
+			keyring: minisignPubText,
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "app_1.0.0_amd64.deb.minisig", content: minisign.Sign(otherPriv, pkg)},
+			},
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "minisign tampered",
+			keyring: minisignPubText,
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "app_1.0.0_amd64.deb.minisig", content: minisign.Sign(minisignPriv, []byte("tampered"))},
+			},
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "openpgp",
+			keyring: pgpPub.Bytes(),
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+				{name: "app_1.0.0_amd64.deb.asc", content: pgpSig.Bytes()},
+			},
+		},
+		{
+			name:    "signature not found",
+			keyring: pgpPub.Bytes(),
+			assets: []fakeAsset{
+				{name: "app_1.0.0_amd64.deb", content: pkg},
+			},
+			wantErr: ErrSignatureInvalid,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keyringPath := filepath.Join(t.TempDir(), "keyring")
+			assert.NoError(t, os.WriteFile(keyringPath, tc.keyring, 0600))
+
+			f := &fakeGitHub{
+				releases: []fakeRelease{
+					{tag: "v1.0.0", publishedAt: time.Now(), assets: tc.assets},
+				},
+			}
+			g := newTestGitHub(t, f, &Config{
+				SignatureKeyring: keyringPath,
+			})
+
+			tag, file, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+			assert.Equal(t, "v1.0.0", tag)
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+				assert.Equal(t, "", file)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(g.config.SaveAssetsPath, "v1.0.0", "app_1.0.0_amd64.deb"), file)
+		})
+	}
+}
+
+func TestDownloadReleaseAssetSemver(t *testing.T) {
+	now := time.Now()
+	asset := func(tag string) []fakeAsset {
+		return []fakeAsset{{name: fmt.Sprintf("app_%s_amd64.deb", tag), content: []byte(tag)}}
+	}
+	f := &fakeGitHub{
+		releases: []fakeRelease{
+			{tag: "v2.3.0", publishedAt: now.Add(-5 * time.Hour), assets: asset("v2.3.0")},
+			{tag: "v2.4.1", publishedAt: now.Add(-4 * time.Hour), assets: asset("v2.4.1")},
+			{tag: "v3.0.0", publishedAt: now.Add(-3 * time.Hour), assets: asset("v3.0.0")},
+			{tag: "v3.1.0-rc1", prerelease: true, publishedAt: now.Add(-2 * time.Hour), assets: asset("v3.1.0-rc1")},
+			// hotfix of an old line published later
+			{tag: "v2.3.5", publishedAt: now.Add(-1 * time.Hour), assets: asset("v2.3.5")},
+			{tag: "nightly", publishedAt: now, assets: asset("nightly")},
+		},
+	}
+
+	testCases := []struct {
+		name    string
+		config  *Config
+		wantTag string
+		wantErr error
+	}{
+		{
+			name:    "highest version",
+			config:  &Config{},
+			wantTag: "v3.0.0",
+		},
+		{
+			name:    "range",
+			config:  &Config{VersionConstraint: ">=2.3.0, <3.0.0"},
+			wantTag: "v2.4.1",
+		},
+		{
+			name:    "tilde",
+			config:  &Config{VersionConstraint: "~2.3"},
+			wantTag: "v2.3.5",
+		},
+		{
+			name:    "include prerelease",
+			config:  &Config{IncludePreRelease: true},
+			wantTag: "v3.1.0-rc1",
+		},
+		{
+			name:    "exclude pattern",
+			config:  &Config{TagExcludePattern: `^v3\.`},
+			wantTag: "v2.4.1",
+		},
+		{
+			name:    "include pattern",
+			config:  &Config{TagIncludePattern: `^v2\.3\.`},
+			wantTag: "v2.3.5",
+		},
+		{
+			name:    "no match",
+			config:  &Config{VersionConstraint: ">=4.0.0"},
+			wantErr: ErrAssetsNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.ReleaseSelection = ReleaseSelectionSemver
+			g := newTestGitHub(t, f, tc.config)
+
+			tag, file, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantTag, tag)
+			assert.Equal(t, filepath.Join(g.config.SaveAssetsPath, tc.wantTag, fmt.Sprintf("app_%s_amd64.deb", tc.wantTag)), file)
+		})
+	}
+}
+
+func TestNewGitHubSelectionPolicy(t *testing.T) {
+	_, err := NewGitHub(&Config{
+		Repo:               "foo/bar",
+		PackageNamePattern: ".*",
+		VersionConstraint:  ">=1.0.0",
+	})
+	assert.Error(t, err)
+}
+
+func TestGitHubAppAuthentication(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "app.pem")
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+
+	f := &fakeGitHub{
+		installationToken: "ghs_installation",
+		releases: []fakeRelease{
+			{tag: "v1.0.0", publishedAt: time.Now().Add(-time.Hour), assets: []fakeAsset{{name: "app_1.0.0_amd64.deb", content: []byte("v1.0.0")}}},
+			{tag: "v1.1.0", publishedAt: time.Now(), assets: []fakeAsset{{name: "app_1.1.0_amd64.deb", content: []byte("v1.1.0")}}},
+		},
+	}
+	g := newTestGitHub(t, f, &Config{
+		GitHubAppID:             1,
+		GitHubAppPrivateKeyPath: keyPath,
+	})
+
+	tag, _, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+
+	tag, _, err = g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+
+	// the token is refreshed because it is about to expire
+	assert.True(t, f.tokenRequests > 1)
+}
+
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gacr"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	assert.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certPath, keyPath, pool
+}
+
+func TestGitHubEnterprise(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, clientCAs := writeClientCert(t, dir)
+
+	f := &fakeGitHub{
+		prefix:    "/api/v3",
+		redirect:  true,
+		tlsConfig: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs},
+		releases: []fakeRelease{
+			{tag: "v1.0.0", publishedAt: time.Now(), assets: []fakeAsset{{name: "app_1.0.0_amd64.deb", content: []byte("v1.0.0")}}},
+		},
+	}
+	srv := f.serve(t)
+	caPath := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	// the configured endpoint takes precedence over the environment
+	t.Setenv("GITHUB_API_URL", "http://127.0.0.1:1")
+	t.Setenv("GITHUB_TOKEN", "dummy")
+
+	newConfig := func() *Config {
+		return &Config{
+			Repo:               "foo/bar",
+			SaveAssetsPath:     t.TempDir(),
+			PackageNamePattern: `.*\.deb$`,
+			GitHubAPIEndpoint:  srv.URL + "/api/v3",
+			TLSCACert:          caPath,
+			TLSClientCert:      certPath,
+			TLSClientKey:       keyPath,
+		}
+	}
+
+	g, err := NewGitHub(newConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/api/v3/", g.client.BaseURL.String())
+	assert.Equal(t, srv.URL+"/api/uploads/", g.client.UploadURL.String())
+
+	tag, filename, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	b, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", string(b))
+	assert.Equal(t, 0, f.leakedTokens)
+
+	config := newConfig()
+	config.GitHubUploadURL = "https://uploads.example.com"
+	g, err = NewGitHub(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://uploads.example.com/", g.client.UploadURL.String())
+
+	// the server requires the client certificate
+	config = newConfig()
+	config.TLSClientCert = ""
+	config.TLSClientKey = ""
+	g, err = NewGitHub(config)
+	assert.NoError(t, err)
+	_, err = g.ResolveRelease(context.Background(), LatestTag)
+	assert.Error(t, err)
+
+	config = newConfig()
+	config.TLSCACert = keyPath
+	_, err = NewGitHub(config)
+	assert.Error(t, err)
+}
+
+func TestHTTPTransportProxy(t *testing.T) {
+	tr, err := newHTTPTransport(&Config{HTTPProxy: "http://proxy.example.com:3128", NoProxy: "internal.example.com"})
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "https://ghes.example.com/api/v3/repos/foo/bar/releases", nil)
+	u, err := tr.Proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy.example.com:3128", u.String())
+
+	req, _ = http.NewRequest("GET", "https://internal.example.com/foo", nil)
+	u, err = tr.Proxy(req)
+	assert.NoError(t, err)
+	assert.Nil(t, u)
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultGitLabAPIEndpoint = "https://gitlab.com/api/v4"
+
+type GitLab struct {
+	*assetDownloader
+	client   *http.Client
+	endpoint *url.URL
+	project  string
+	token    string
+}
+
+type gitLabRelease struct {
+	TagName         string    `json:"tag_name"`
+	ReleasedAt      time.Time `json:"released_at"`
+	UpcomingRelease bool      `json:"upcoming_release"`
+	Description     string    `json:"description"`
+	Assets          struct {
+		Links []*gitLabLink `json:"links"`
+	} `json:"assets"`
+}
+
+type gitLabLink struct {
+	ID             int64  `json:"id"`
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	DirectAssetURL string `json:"direct_asset_url"`
+}
+
+func NewGitLab(config *Config) (*GitLab, error) {
+	token := config.GitLabToken
+	if token == "" {
+		token = os.Getenv("GITLAB_TOKEN")
+	}
+
+	ep := config.GitLabAPIEndpoint
+	if ep == "" {
+		ep = defaultGitLabAPIEndpoint
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(ep, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gitlab api endpoint: %s", err)
+	}
+
+	if !strings.Contains(config.Repo, "/") {
+		return nil, fmt.Errorf("invalid repo: %s", config.Repo)
+	}
+
+	tr, err := newHTTPTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GitLab{
+		client:   &http.Client{Transport: tr},
+		endpoint: endpoint,
+		project:  config.Repo,
+		token:    token,
+	}
+
+	d, err := newAssetDownloader(config, g)
+	if err != nil {
+		return nil, err
+	}
+	g.assetDownloader = d
+	return g, nil
+}
+
+func newGitLabRelease(r *gitLabRelease) *release {
+	ret := &release{
+		tag: r.TagName,
+		// upcoming releases are not released yet
+		draft:       r.UpcomingRelease,
+		publishedAt: r.ReleasedAt,
+		body:        r.Description,
+	}
+	for _, l := range r.Assets.Links {
+		u := l.DirectAssetURL
+		if u == "" {
+			u = l.URL
+		}
+		ret.assets = append(ret.assets, &releaseAsset{
+			id:   l.ID,
+			name: l.Name,
+			url:  u,
+		})
+	}
+	return ret
+}
+
+func (g *GitLab) newRequest(ctx context.Context, u string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// never send the token to other hosts
+	if g.token != "" && req.URL.Host == g.endpoint.Host {
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+	return req, nil
+}
+
+func (g *GitLab) get(ctx context.Context, path string, query url.Values, v interface{}) (*http.Response, error) {
+	u := fmt.Sprintf("%s/projects/%s%s", g.endpoint.String(), url.PathEscape(g.project), path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := g.newRequest(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError("GET", path, res.StatusCode)
+	}
+	return res, json.NewDecoder(res.Body).Decode(v)
+}
+
+func (g *GitLab) latestRelease(ctx context.Context) (*release, error) {
+	r := &gitLabRelease{}
+	if _, err := g.get(ctx, "/releases/permalink/latest", nil, r); err != nil {
+		return nil, err
+	}
+	return newGitLabRelease(r), nil
+}
+
+func (g *GitLab) releaseByTag(ctx context.Context, tag string) (*release, error) {
+	r := &gitLabRelease{}
+	if _, err := g.get(ctx, "/releases/"+url.PathEscape(tag), nil, r); err != nil {
+		return nil, err
+	}
+	return newGitLabRelease(r), nil
+}
+
+func (g *GitLab) listReleases(ctx context.Context) ([]*release, error) {
+	var allReleases []*release
+	page := 1
+
+	for {
+		releases := []*gitLabRelease{}
+		res, err := g.get(ctx, "/releases", url.Values{
+			"per_page": []string{"100"},
+			"page":     []string{strconv.Itoa(page)},
+		}, &releases)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range releases {
+			allReleases = append(allReleases, newGitLabRelease(r))
+		}
+
+		next, err := strconv.Atoi(res.Header.Get("X-Next-Page"))
+		if err != nil || next == 0 {
+			break
+		}
+		page = next
+	}
+	return allReleases, nil
+}
+
+func (g *GitLab) openAsset(ctx context.Context, asset *releaseAsset, offset int64) (io.ReadCloser, int64, error) {
+	req, err := g.newRequest(ctx, asset.url)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rangeGet(g.client, req, offset)
+}
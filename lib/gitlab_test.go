@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tj/assert"
+)
+
+// fakeGitLab is a minimal stand-in for the GitLab releases and generic packages API
+type fakeGitLab struct {
+	releases []fakeRelease
+	token    string
+}
+
+func (f *fakeGitLab) releaseJSON(serverURL string, r fakeRelease) map[string]interface{} {
+	links := []map[string]interface{}{}
+	for j, a := range r.assets {
+		links = append(links, map[string]interface{}{
+			"id":               j + 1,
+			"name":             a.name,
+			"url":              fmt.Sprintf("%s/foo/bar/-/releases/%s/downloads/%s", serverURL, r.tag, a.name),
+			"direct_asset_url": fmt.Sprintf("%s/api/v4/projects/foo%%2Fbar/packages/generic/bar/%s/%s", serverURL, r.tag, a.name),
+			"link_type":        "package",
+		})
+	}
+	return map[string]interface{}{
+		"tag_name":    r.tag,
+		"released_at": r.publishedAt.Format(time.RFC3339),
+		"assets": map[string]interface{}{
+			"links": links,
+		},
+	}
+}
+
+func (f *fakeGitLab) serve(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != f.token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := r.URL.EscapedPath()
+		prefix := "/api/v4/projects/foo%2Fbar"
+		if !strings.HasPrefix(path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		path = strings.TrimPrefix(path, prefix)
+
+		switch {
+		case path == "/releases/permalink/latest":
+			latest := -1
+			for i, rel := range f.releases {
+				if latest < 0 || rel.publishedAt.After(f.releases[latest].publishedAt) {
+					latest = i
+				}
+			}
+			json.NewEncoder(w).Encode(f.releaseJSON(srv.URL, f.releases[latest]))
+			return
+		case path == "/releases":
+			releases := []map[string]interface{}{}
+			for _, rel := range f.releases {
+				releases = append(releases, f.releaseJSON(srv.URL, rel))
+			}
+			json.NewEncoder(w).Encode(releases)
+			return
+		case strings.HasPrefix(path, "/releases/"):
+			for _, rel := range f.releases {
+				if "/releases/"+rel.tag == path {
+					json.NewEncoder(w).Encode(f.releaseJSON(srv.URL, rel))
+					return
+				}
+			}
+		case strings.HasPrefix(path, "/packages/generic/bar/"):
+			for _, rel := range f.releases {
+				for _, a := range rel.assets {
+					if path == fmt.Sprintf("/packages/generic/bar/%s/%s", rel.tag, a.name) {
+						w.Write(a.content)
+						return
+					}
+				}
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGitLabDownloadReleaseAsset(t *testing.T) {
+	pkg := []byte("package body")
+	f := &fakeGitLab{
+		token: "secret",
+		releases: []fakeRelease{
+			{
+				tag:         "v1.0.0",
+				publishedAt: time.Now().Add(-time.Hour),
+				assets:      []fakeAsset{{name: "app_1.0.0_amd64.deb", content: []byte("old")}},
+			},
+			{
+				tag:         "v1.1.0",
+				publishedAt: time.Now(),
+				assets: []fakeAsset{
+					{name: "app_1.1.0_amd64.deb", content: pkg},
+					{name: "checksums.txt", content: []byte(sha256sum(pkg) + "  app_1.1.0_amd64.deb\n")},
+				},
+			},
+		},
+	}
+	srv := f.serve(t)
+
+	testCases := []struct {
+		name     string
+		tag      string
+		token    string
+		wantTag  string
+		wantFile string
+		wantErr  error
+	}{
+		{
+			name:     "latest",
+			tag:      LatestTag,
+			token:    "secret",
+			wantTag:  "v1.1.0",
+			wantFile: "app_1.1.0_amd64.deb",
+		},
+		{
+			name:     "by tag",
+			tag:      "v1.0.0",
+			token:    "secret",
+			wantTag:  "v1.0.0",
+			wantFile: "app_1.0.0_amd64.deb",
+		},
+		{
+			name:    "unauthorized",
+			tag:     "v1.0.0",
+			token:   "invalid",
+			wantErr: ErrAssetsCannotDownload,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &Config{
+				Source:             SourceGitLab,
+				Repo:               "foo/bar",
+				GitLabToken:        tc.token,
+				GitLabAPIEndpoint:  srv.URL + "/api/v4",
+				SaveAssetsPath:     t.TempDir(),
+				PackageNamePattern: `.*\.deb$`,
+				ChecksumPattern:    `checksums\.txt$`,
+			}
+			source, err := NewReleaseSource(config)
+			assert.NoError(t, err)
+
+			tag, file, err := source.DownloadReleaseAsset(context.Background(), tc.tag)
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantTag, tag)
+			assert.Equal(t, filepath.Join(config.SaveAssetsPath, tc.wantTag, tc.wantFile), file)
+			_, err = os.Stat(file)
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+var osReleasePath = "/etc/os-release"
+
+// uname -m style names of GOARCH
+var machineNames = map[string]string{
+	"amd64": "x86_64",
+	"386":   "i686",
+	"arm64": "aarch64",
+}
+
+// HostVars are the variables of the asset pattern templates
+type HostVars struct {
+	OS             string
+	Arch           string
+	Machine        string
+	DistroID       string
+	DistroVersion  string
+	DistroCodename string
+	Hostname       string
+	Labels         map[string]string
+}
+
+func parseOSRelease(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		ret[k] = strings.Trim(v, `"'`)
+	}
+	return ret, nil
+}
+
+func newHostVars(config *Config) (*HostVars, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %s", err)
+	}
+
+	machine, ok := machineNames[runtime.GOARCH]
+	if !ok {
+		machine = runtime.GOARCH
+	}
+
+	v := &HostVars{
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Machine:  machine,
+		Hostname: hostname,
+		Labels:   config.HostLabels,
+	}
+	if v.Labels == nil {
+		v.Labels = map[string]string{}
+	}
+
+	osRelease, err := parseOSRelease(osReleasePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %s", osReleasePath, err)
+	}
+	v.DistroID = osRelease["ID"]
+	v.DistroVersion = osRelease["VERSION_ID"]
+	v.DistroCodename = osRelease["VERSION_CODENAME"]
+	if v.DistroCodename == "" {
+		v.DistroCodename = osRelease["UBUNTU_CODENAME"]
+	}
+	return v, nil
+}
+
+// quoted returns the variables escaped to match literally in a regexp
+func (v *HostVars) quoted() *HostVars {
+	q := &HostVars{
+		OS:             regexp.QuoteMeta(v.OS),
+		Arch:           regexp.QuoteMeta(v.Arch),
+		Machine:        regexp.QuoteMeta(v.Machine),
+		DistroID:       regexp.QuoteMeta(v.DistroID),
+		DistroVersion:  regexp.QuoteMeta(v.DistroVersion),
+		DistroCodename: regexp.QuoteMeta(v.DistroCodename),
+		Hostname:       regexp.QuoteMeta(v.Hostname),
+		Labels:         make(map[string]string, len(v.Labels)),
+	}
+	for k, l := range v.Labels {
+		q.Labels[k] = regexp.QuoteMeta(l)
+	}
+	return q
+}
+
+// resolvePattern executes the pattern as a template when it has actions.
+// The variables match literally, a dot of the hostname or the version doesn't match any character.
+func (v *HostVars) resolvePattern(pattern string) (string, error) {
+	if !strings.Contains(pattern, "{{") {
+		return pattern, nil
+	}
+
+	t, err := template.New("pattern").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, v.quoted()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestResolvePattern(t *testing.T) {
+	osRelease := filepath.Join(t.TempDir(), "os-release")
+	assert.NoError(t, os.WriteFile(osRelease, []byte(`NAME="Ubuntu"
+ID=ubuntu
+VERSION_ID="22.04"
+VERSION_CODENAME=jammy
+`), 0644))
+	defer func(p string) { osReleasePath = p }(osReleasePath)
+	osReleasePath = osRelease
+
+	v, err := newHostVars(&Config{HostLabels: map[string]string{"role": "web"}})
+	assert.NoError(t, err)
+	v.Hostname = "web01.example.com"
+
+	testCases := []struct {
+		name    string
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "no template",
+			pattern: `stns-v.*_amd64\.jammy\.deb$`,
+			want:    `stns-v.*_amd64\.jammy\.deb$`,
+		},
+		{
+			name:    "host variables",
+			pattern: `stns-v.*_{{.Arch}}\.{{.DistroCodename}}\.deb$`,
+			want:    `stns-v.*_` + runtime.GOARCH + `\.jammy\.deb$`,
+		},
+		{
+			name:    "distro and labels",
+			pattern: `app-{{.Labels.role}}_{{.DistroID}}{{.DistroVersion}}_{{.OS}}\.tar\.gz$`,
+			want:    `app-web_ubuntu22\.04_` + runtime.GOOS + `\.tar\.gz$`,
+		},
+		{
+			name:    "dotted hostname",
+			pattern: `config-{{.Hostname}}\.tar\.gz$`,
+			want:    `config-web01\.example\.com\.tar\.gz$`,
+		},
+		{
+			name:    "unknown label",
+			pattern: `app-{{.Labels.zone}}\.deb$`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := v.resolvePattern(tc.pattern)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
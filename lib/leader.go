@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LeaderSource lets only the leader of the fleet poll the release source.
+// The leader publishes the resolved release to redis and the followers read it,
+// so the API usage doesn't grow with the number of members.
+type LeaderSource struct {
+	ReleaseSource
+	state  *State
+	config *Config
+}
+
+// assetMatcher is implemented by the release sources which match the assets by the patterns of this host
+type assetMatcher interface {
+	matchAssets(names []string) []string
+}
+
+func NewLeaderSource(config *Config, source ReleaseSource, state *State) *LeaderSource {
+	return &LeaderSource{
+		ReleaseSource: source,
+		state:         state,
+		config:        config,
+	}
+}
+
+func (l *LeaderSource) lease() time.Duration {
+	if l.config.LeaderLease > 0 {
+		return l.config.LeaderLease
+	}
+	return l.config.RepositryPollingInterval * 3
+}
+
+func (l *LeaderSource) ResolveRelease(ctx context.Context, tag string) (*ReleaseInfo, error) {
+	if tag != LatestTag {
+		return l.ReleaseSource.ResolveRelease(ctx, tag)
+	}
+
+	leader, err := l.state.TryPollerLease(l.lease())
+	if err != nil {
+		return nil, fmt.Errorf("can't get poller lease: %w", err)
+	}
+
+	if leader {
+		info, err := l.ReleaseSource.ResolveRelease(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.state.PublishReleaseInfo(info); err != nil {
+			return nil, fmt.Errorf("can't publish release info: %w", err)
+		}
+		slog.Debug("published release info as leader", "tag", info.Tag, "asset", info.Asset)
+		return info, nil
+	}
+
+	info, err := l.state.PublishedReleaseInfo()
+	if err != nil {
+		return nil, fmt.Errorf("can't get published release info: %w", err)
+	}
+	if info == nil {
+		return nil, errors.Wrap(ErrAssetsNotFound, "release info is not published by the leader yet")
+	}
+	// the patterns of the leader may match other assets by the host variables
+	if m, ok := l.ReleaseSource.(assetMatcher); ok {
+		names := make([]string, 0, len(info.Fingerprints))
+		for name := range info.Fingerprints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		info.Matched = m.matchAssets(names)
+	}
+	slog.Debug("read release info published by leader", "tag", info.Tag, "asset", info.Asset)
+	return info, nil
+}
+
+// DownloadReleaseAsset verifies the downloaded asset against the digest published by the leader
+// when this host downloaded the same asset as the leader
+func (l *LeaderSource) DownloadReleaseAsset(ctx context.Context, tag string) (string, string, error) {
+	t, file, err := l.ReleaseSource.DownloadReleaseAsset(ctx, tag)
+	if err != nil {
+		return t, file, err
+	}
+
+	info, err := l.state.PublishedReleaseInfo()
+	if err != nil {
+		return "", "", fmt.Errorf("can't get published release info: %w", err)
+	}
+	if info == nil || info.Tag != t || info.Digest == "" || filepath.Base(file) != info.Asset {
+		return t, file, nil
+	}
+
+	if err := verifyDigest(file, info.Asset, info.Digest); err != nil {
+		if err := os.Remove(file); err != nil {
+			slog.Warn("can't remove invalid asset", "path", file, "err", err)
+		}
+		return t, "", err
+	}
+	return t, file, nil
+}
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pyama86/git-assets-canary-releaser/testutils"
+	"github.com/tj/assert"
+)
+
+type fakeReleaseSource struct {
+	info     *ReleaseInfo
+	file     string
+	resolved int
+}
+
+func (f *fakeReleaseSource) ResolveRelease(ctx context.Context, tag string) (*ReleaseInfo, error) {
+	f.resolved++
+	return f.info, nil
+}
+
+func (f *fakeReleaseSource) DownloadReleaseAsset(ctx context.Context, tag string) (string, string, error) {
+	return tag, f.file, nil
+}
+
+// matchingReleaseSource matches the assets by the patterns of the host like the release sources
+type matchingReleaseSource struct {
+	*fakeReleaseSource
+	downloader *assetDownloader
+}
+
+func (m *matchingReleaseSource) matchAssets(names []string) []string {
+	return m.downloader.matchAssets(names)
+}
+
+func TestLeaderSource(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.RepositryPollingInterval = time.Minute
+
+	newMember := func(name string, source ReleaseSource) *LeaderSource {
+		state, err := NewState(config)
+		assert.NoError(t, err)
+		state.me = name
+		return NewLeaderSource(config, source, state)
+	}
+
+	leaderSource := &fakeReleaseSource{info: &ReleaseInfo{Tag: "v1.0.0", Asset: "app.deb", Size: 3}}
+	followerSource := &fakeReleaseSource{info: &ReleaseInfo{Tag: "v0.0.1"}}
+	leader := newMember("leader", leaderSource)
+	follower := newMember("follower", followerSource)
+
+	assert.NoError(t, redisClient.Del(context.Background(), leader.state.releaseInfoKey).Err())
+	assert.NoError(t, redisClient.Set(context.Background(), leader.state.pollerLeaderKey, "leader", time.Minute).Err())
+
+	// nothing is published before the leader polls
+	_, err := follower.ResolveRelease(context.Background(), LatestTag)
+	assert.True(t, errors.Is(err, ErrAssetsNotFound))
+
+	info, err := leader.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", info.Tag)
+
+	info, err = follower.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderSource.info, info)
+	assert.Equal(t, 1, leaderSource.resolved)
+	assert.Equal(t, 0, followerSource.resolved)
+
+	// the leader keeps the lease
+	_, err = leader.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, leaderSource.resolved)
+
+	// fail over when the lease of the leader is expired
+	assert.NoError(t, redisClient.Del(context.Background(), leader.state.pollerLeaderKey).Err())
+	info, err = follower.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v0.0.1", info.Tag)
+	assert.Equal(t, 1, followerSource.resolved)
+
+	info, err = leader.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v0.0.1", info.Tag)
+	assert.Equal(t, 2, leaderSource.resolved)
+}
+
+func TestLeaderSourceHostAssets(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.RepositryPollingInterval = time.Minute
+
+	state, err := NewState(config)
+	assert.NoError(t, err)
+	state.me = "leader"
+	leaderInfo := &ReleaseInfo{
+		Tag:          "v1.0.0",
+		Asset:        "app_amd64.deb",
+		Digest:       strings.Repeat("0", 64),
+		Fingerprints: map[string]string{"app_amd64.deb": "1", "app_arm64.deb": "2", "README.md": "3"},
+		Matched:      []string{"app_amd64.deb"},
+	}
+	leader := NewLeaderSource(config, &fakeReleaseSource{info: leaderInfo}, state)
+
+	assert.NoError(t, redisClient.Del(context.Background(), state.releaseInfoKey).Err())
+	assert.NoError(t, redisClient.Set(context.Background(), state.pollerLeaderKey, "leader", time.Minute).Err())
+	_, err = leader.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+
+	followerState, err := NewState(config)
+	assert.NoError(t, err)
+	followerState.me = "follower"
+	arm64 := filepath.Join(t.TempDir(), "app_arm64.deb")
+	assert.NoError(t, os.WriteFile(arm64, []byte("arm64"), 0644))
+	source := &matchingReleaseSource{
+		fakeReleaseSource: &fakeReleaseSource{file: arm64},
+		downloader:        &assetDownloader{patterns: []*assetPattern{{reg: regexp.MustCompile(`_arm64\.deb$`)}}},
+	}
+	follower := NewLeaderSource(config, source, followerState)
+
+	// the follower compares the assets matched by its own patterns
+	info, err := follower.ResolveRelease(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app_arm64.deb"}, info.Matched)
+
+	// the digest of the leader is for another asset
+	_, file, err := follower.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, arm64, file)
+
+	amd64 := filepath.Join(t.TempDir(), "app_amd64.deb")
+	assert.NoError(t, os.WriteFile(amd64, []byte("amd64"), 0644))
+	source.file = amd64
+	_, _, err = follower.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+}
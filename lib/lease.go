@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the renewal runs at a third of the ttl, a shorter ttl is expired before it is renewed
+const minLeaseTTL = time.Second
+
+// Lease is a lock held by a member. The lock stores the holder and the acquisition time,
+// so that only the holder can renew and release it and the writes of a stale holder are fenced off.
+type Lease struct {
+	Holder string `json:"holder"`
+	Tag    string `json:"tag"`
+	// AcquiredAt makes the lock value unique to each acquisition
+	AcquiredAt time.Time `json:"acquired_at"`
+	// Token increases every time the lock is acquired, a stale holder has a smaller token
+	Token int64 `json:"-"`
+
+	key   string
+	value string
+	ttl   time.Duration
+	state *State
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+	lost chan struct{}
+}
+
+func leaseTokenKey(key string) string {
+	return key + "_token"
+}
+
+// tryLease acquires the lock, the lease is nil when another member holds it
+func (s *State) tryLease(key, tag string, ttl time.Duration) (*Lease, error) {
+	ttl = max(ttl, minLeaseTTL)
+	l := &Lease{
+		Holder:     s.me,
+		Tag:        tag,
+		AcquiredAt: time.Now(),
+		key:        key,
+		ttl:        ttl,
+		state:      s,
+		lost:       make(chan struct{}),
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	l.value = string(b)
+
+	ok, err := s.backend.TryLock(context.Background(), key, l.value, ttl)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	// the token is counted only by the holders, a failed attempt doesn't consume it
+	l.Token, err = s.backend.Incr(context.Background(), leaseTokenKey(key))
+	if err != nil {
+		if _, uerr := s.backend.Unlock(context.Background(), key, l.value); uerr != nil {
+			slog.Warn("can't unlock lease", "key", key, "err", uerr)
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+// ResumeCanaryReleaseLock takes over the lease of the canary release which this member held before restart.
+// The lease is acquired again when it is expired, and it is nil when another member holds it.
+func (s *State) ResumeCanaryReleaseLock(tag string, window time.Duration) (*Lease, error) {
+	return s.resumeLease(s.canaryReleaseTagKey, tag, window*2)
+}
+
+func (s *State) resumeLease(key, tag string, ttl time.Duration) (*Lease, error) {
+	ttl = max(ttl, minLeaseTTL)
+	b, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return s.tryLease(key, tag, ttl)
+	}
+
+	l := &Lease{}
+	if err := json.Unmarshal(b, l); err != nil || l.Holder != s.me || l.Tag != tag {
+		return nil, nil
+	}
+	l.key = key
+	l.value = string(b)
+	l.ttl = ttl
+	l.state = s
+	l.lost = make(chan struct{})
+
+	ok, err := s.backend.ExtendLock(context.Background(), key, l.value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// expired in between
+		return s.tryLease(key, tag, ttl)
+	}
+
+	// no one else has acquired the lock since this member did, so the counter is still its token
+	if b, err := s.get(leaseTokenKey(key)); err != nil {
+		return nil, err
+	} else if b != nil {
+		if l.Token, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid lease token %s: %s", key, err)
+		}
+	}
+	return l, nil
+}
+
+// KeepAlive renews the lease in the background until Stop or Release is called
+func (l *Lease) KeepAlive() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				ok, err := l.state.backend.ExtendLock(context.Background(), l.key, l.value, l.ttl)
+				if err != nil {
+					// the lease is still valid until the ttl, try again at the next tick
+					slog.Warn("can't renew lease", "key", l.key, "token", l.Token, "err", err)
+					continue
+				}
+				if !ok {
+					slog.Error("lease is lost", "key", l.key, "tag", l.Tag, "token", l.Token)
+					close(l.lost)
+					return
+				}
+			}
+		}
+	}()
+}
+
+var ErrLeaseLost = errors.New("lease lost")
+
+// Lost is closed when the renewal found that the lease is lost
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Check returns ErrLeaseLost when the renewal found that the lease is lost
+func (l *Lease) Check() error {
+	select {
+	case <-l.lost:
+		return fmt.Errorf("%w: key:%s tag:%s token:%d", ErrLeaseLost, l.key, l.Tag, l.Token)
+	default:
+		return nil
+	}
+}
+
+// Stop stops the renewal, the lock is kept until the ttl
+func (l *Lease) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		return
+	}
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	<-l.done
+}
+
+// Release stops the renewal and deletes the lock only when this member still holds it
+func (l *Lease) Release() error {
+	l.Stop()
+	ok, err := l.state.backend.Unlock(context.Background(), l.key, l.value)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		slog.Warn("lease was already lost before release", "key", l.key, "tag", l.Tag, "token", l.Token)
+	}
+	return nil
+}
+
+// commit writes the values and the set members only while this member holds the lease, ErrLeaseLost otherwise
+func (l *Lease) commit(values map[string][]byte, members map[string][]string) error {
+	ok, err := l.state.backend.SetAllIfLocked(context.Background(), l.key, l.value, values, members)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: key:%s tag:%s token:%d", ErrLeaseLost, l.key, l.Tag, l.Token)
+	}
+	return nil
+}
+
+// SaveStableRelease promotes the release only while this member holds the lease,
+// a member whose canary release is taken over never overwrites the stable tag
+func (l *Lease) SaveStableRelease(info *ReleaseInfo) error {
+	values, err := l.state.stableReleaseValues(info)
+	if err != nil {
+		return err
+	}
+	return l.commit(values, nil)
+}
+
+// SavePendingPromotion saves the release waiting for the manual promotion only while this member holds the lease
+func (l *Lease) SavePendingPromotion(info *ReleaseInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return l.commit(map[string][]byte{l.state.pendingPromotionKey: b}, nil)
+}
+
+// SaveAvoidReleaseTag is SaveAvoidReleaseTag of State fenced by the lease
+func (l *Lease) SaveAvoidReleaseTag(tag string) error {
+	return l.commit(nil, map[string][]string{l.state.avoidReleaseTagKey: {tag}})
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestLease(t *testing.T) {
+	config := newTestConfig()
+	config.StateBackend = StateBackendFile
+	config.FileState = &FileStateConfig{Dir: t.TempDir()}
+
+	newMember := func(name string) *State {
+		state, err := NewState(config)
+		assert.NoError(t, err)
+		state.me = name
+		return state
+	}
+	a, b := newMember("a"), newMember("b")
+
+	lease, err := a.tryLease(a.canaryReleaseTagKey, "v1.0.0", 3*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", lease.Holder)
+
+	// the renewal keeps the lease beyond the ttl
+	lease.KeepAlive()
+	time.Sleep(4 * time.Second)
+	other, err := b.tryLease(b.canaryReleaseTagKey, "v1.0.0", 3*time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, other)
+	assert.NoError(t, lease.Check())
+	assert.NoError(t, lease.SaveStableRelease(&ReleaseInfo{Tag: "v1.0.0"}))
+
+	// a member can't release the lock held by another member
+	lease.Stop()
+	assert.NoError(t, b.backend.Delete(context.Background(), b.canaryReleaseTagKey))
+	other, err = b.tryLease(b.canaryReleaseTagKey, "v1.0.0", time.Minute)
+	assert.NoError(t, err)
+	// the failed attempt above doesn't consume a token
+	assert.Equal(t, lease.Token+1, other.Token)
+	assert.NoError(t, lease.Release())
+
+	// the stale holder can't overwrite the state
+	assert.True(t, errors.Is(lease.SaveStableRelease(&ReleaseInfo{Tag: "v0.9.0"}), ErrLeaseLost))
+	assert.True(t, errors.Is(lease.SaveAvoidReleaseTag("v1.0.0"), ErrLeaseLost))
+	assert.NoError(t, other.SaveAvoidReleaseTag("v1.1.0"))
+	tag, err := b.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	avoided, err := b.getReleases(b.avoidReleaseTagKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1.1.0"}, avoided)
+	_, err = b.backend.Get(context.Background(), b.canaryReleaseTagKey)
+	assert.NoError(t, err)
+
+	// the renewal finds that the lease is taken over
+	stale, err := a.tryLease(a.rolloutKey, "v1.0.0", time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, a.backend.Delete(context.Background(), a.rolloutKey))
+	taken, err := b.tryLease(b.rolloutKey, "v1.0.0", time.Minute)
+	assert.NoError(t, err)
+	assert.NotNil(t, taken)
+	stale.KeepAlive()
+	time.Sleep(1500 * time.Millisecond)
+	stale.Stop()
+	assert.True(t, errors.Is(stale.Check(), ErrLeaseLost))
+}
@@ -0,0 +1,288 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metadata file placed in <root>/<tag>/
+const mirrorReleaseMetadata = "release.json"
+
+// index file served at <base>/
+const mirrorIndex = "index.json"
+
+// Mirror reads releases from a directory layout(<root>/<tag>/<asset>)
+// or an HTTP index(<base>/index.json) served by an internal mirror
+type Mirror struct {
+	*assetDownloader
+	client *http.Client
+	root   string
+	base   *url.URL
+}
+
+type mirrorRelease struct {
+	Tag         string         `json:"tag"`
+	Draft       bool           `json:"draft"`
+	Prerelease  bool           `json:"prerelease"`
+	PublishedAt time.Time      `json:"published_at"`
+	Body        string         `json:"body"`
+	Assets      []*mirrorAsset `json:"assets"`
+}
+
+type mirrorAsset struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// relative to <base>/<tag>/ when it is not an absolute URL
+	URL string `json:"url"`
+}
+
+func NewMirror(config *Config) (*Mirror, error) {
+	if config.MirrorURL == "" {
+		return nil, errors.New("mirror_url is required when source is mirror")
+	}
+
+	tr, err := newHTTPTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mirror{
+		client: &http.Client{Transport: tr},
+	}
+
+	if strings.HasPrefix(config.MirrorURL, "http://") || strings.HasPrefix(config.MirrorURL, "https://") {
+		u, err := url.Parse(strings.TrimSuffix(config.MirrorURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror url: %s", err)
+		}
+		m.base = u
+	} else {
+		m.root = config.MirrorURL
+	}
+
+	d, err := newAssetDownloader(config, m)
+	if err != nil {
+		return nil, err
+	}
+	m.assetDownloader = d
+	return m, nil
+}
+
+func (m *Mirror) latestRelease(ctx context.Context) (*release, error) {
+	releases, err := m.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *release
+	for _, r := range releases {
+		if r.draft || r.prerelease {
+			continue
+		}
+		if latest == nil || r.publishedAt.After(latest.publishedAt) {
+			latest = r
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("no release found in mirror")
+	}
+	return latest, nil
+}
+
+func (m *Mirror) releaseByTag(ctx context.Context, tag string) (*release, error) {
+	if m.base == nil {
+		return m.readReleaseDir(tag)
+	}
+
+	releases, err := m.listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range releases {
+		if r.tag == tag {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("release not found in mirror: %s", tag)
+}
+
+func (m *Mirror) listReleases(ctx context.Context) ([]*release, error) {
+	if m.base == nil {
+		return m.listReleaseDirs()
+	}
+	return m.fetchIndex(ctx)
+}
+
+func (m *Mirror) listReleaseDirs() ([]*release, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []*release
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		r, err := m.readReleaseDir(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return releases, nil
+}
+
+func (m *Mirror) readReleaseDir(tag string) (*release, error) {
+	if tag != filepath.Base(tag) {
+		return nil, fmt.Errorf("invalid tag: %s", tag)
+	}
+	dir := filepath.Join(m.root, tag)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &mirrorRelease{
+		Tag:         tag,
+		PublishedAt: fi.ModTime(),
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, mirrorReleaseMetadata)); err == nil {
+		if err := json.Unmarshal(b, meta); err != nil {
+			return nil, fmt.Errorf("invalid release metadata %s: %s", tag, err)
+		}
+		meta.Tag = tag
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &release{
+		tag:         tag,
+		draft:       meta.Draft,
+		prerelease:  meta.Prerelease,
+		publishedAt: meta.PublishedAt,
+		body:        meta.Body,
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == mirrorReleaseMetadata {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		r.assets = append(r.assets, &releaseAsset{
+			id:        mirrorAssetID(e.Name(), info.Size(), info.ModTime()),
+			name:      e.Name(),
+			size:      info.Size(),
+			url:       filepath.Join(dir, e.Name()),
+			updatedAt: info.ModTime(),
+		})
+	}
+	return r, nil
+}
+
+func (m *Mirror) fetchIndex(ctx context.Context) ([]*release, error) {
+	res, err := m.get(ctx, m.base.ResolveReference(&url.URL{Path: mirrorIndex}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	index := []*mirrorRelease{}
+	if err := json.NewDecoder(res).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid mirror index: %s", err)
+	}
+
+	var releases []*release
+	for _, mr := range index {
+		r := &release{
+			tag:         mr.Tag,
+			draft:       mr.Draft,
+			prerelease:  mr.Prerelease,
+			publishedAt: mr.PublishedAt,
+			body:        mr.Body,
+		}
+		tagBase := m.base.ResolveReference(&url.URL{Path: mr.Tag + "/"})
+		for _, a := range mr.Assets {
+			ref := &url.URL{Path: a.Name}
+			if a.URL != "" {
+				ref, err = url.Parse(a.URL)
+				if err != nil {
+					return nil, fmt.Errorf("invalid asset url %s: %s", a.URL, err)
+				}
+			}
+			r.assets = append(r.assets, &releaseAsset{
+				id:        mirrorAssetID(a.Name, a.Size, a.UpdatedAt),
+				name:      a.Name,
+				size:      a.Size,
+				url:       tagBase.ResolveReference(ref).String(),
+				updatedAt: a.UpdatedAt,
+			})
+		}
+		releases = append(releases, r)
+	}
+	return releases, nil
+}
+
+// mirrorAssetID derives the id from the asset itself, so that it doesn't change when other assets are added
+// but changes when the asset is replaced
+func mirrorAssetID(name string, size int64, updatedAt time.Time) int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", name, size, updatedAt.UTC().Format(time.RFC3339Nano))
+	return int64(h.Sum64() &^ (1 << 63))
+}
+
+func (m *Mirror) get(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, statusError("GET", u, res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+func (m *Mirror) openAsset(ctx context.Context, asset *releaseAsset, offset int64) (io.ReadCloser, int64, error) {
+	if m.base == nil {
+		f, err := os.Open(asset.url)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, offset, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", asset.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rangeGet(m.client, req, offset)
+}
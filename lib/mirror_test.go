@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/tj/assert"
+)
+
+func writeMirrorFile(t *testing.T, root, tag, name, content string) {
+	dir := filepath.Join(root, tag)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirrorDownloadReleaseAsset(t *testing.T) {
+	root := t.TempDir()
+	writeMirrorFile(t, root, "v1.0.0", "app_1.0.0_amd64.deb", "v1.0.0")
+	writeMirrorFile(t, root, "v1.0.0", mirrorReleaseMetadata, `{"published_at":"2024-01-01T00:00:00Z"}`)
+	writeMirrorFile(t, root, "v1.1.0", "app_1.1.0_amd64.deb", "v1.1.0")
+	writeMirrorFile(t, root, "v1.1.0", mirrorReleaseMetadata, `{"published_at":"2024-02-01T00:00:00Z"}`)
+	writeMirrorFile(t, root, "v1.2.0-rc1", "app_1.2.0-rc1_amd64.deb", "v1.2.0-rc1")
+	writeMirrorFile(t, root, "v1.2.0-rc1", mirrorReleaseMetadata, `{"published_at":"2024-03-01T00:00:00Z","prerelease":true}`)
+	writeMirrorFile(t, root, "", mirrorIndex, `[
+  {"tag":"v1.0.0","published_at":"2024-01-01T00:00:00Z","assets":[{"name":"app_1.0.0_amd64.deb"}]},
+  {"tag":"v1.1.0","published_at":"2024-02-01T00:00:00Z","assets":[{"name":"app_1.1.0_amd64.deb"}]},
+  {"tag":"v1.2.0-rc1","published_at":"2024-03-01T00:00:00Z","prerelease":true,"assets":[{"name":"app_1.2.0-rc1_amd64.deb"}]}
+]`)
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer srv.Close()
+
+	for _, mirrorURL := range []string{root, srv.URL} {
+		testCases := []struct {
+			name              string
+			tag               string
+			includePrerelease bool
+			wantTag           string
+			wantErr           error
+		}{
+			{
+				name:    "latest",
+				tag:     LatestTag,
+				wantTag: "v1.1.0",
+			},
+			{
+				name:              "latest prerelease",
+				tag:               LatestTag,
+				includePrerelease: true,
+				wantTag:           "v1.2.0-rc1",
+			},
+			{
+				name:    "by tag",
+				tag:     "v1.0.0",
+				wantTag: "v1.0.0",
+			},
+			{
+				name:    "not found",
+				tag:     "v9.9.9",
+				wantErr: ErrAssetsCannotDownload,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(mirrorURL+" "+tc.name, func(t *testing.T) {
+				config := &Config{
+					Source:             SourceMirror,
+					MirrorURL:          mirrorURL,
+					SaveAssetsPath:     t.TempDir(),
+					PackageNamePattern: `.*\.deb$`,
+					IncludePreRelease:  tc.includePrerelease,
+				}
+				source, err := NewReleaseSource(config)
+				assert.NoError(t, err)
+
+				tag, file, err := source.DownloadReleaseAsset(context.Background(), tc.tag)
+				if tc.wantErr != nil {
+					assert.True(t, errors.Is(err, tc.wantErr))
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, tc.wantTag, tag)
+				b, err := os.ReadFile(file)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.wantTag, string(b))
+			})
+		}
+	}
+}
+
+func TestMirrorAssetID(t *testing.T) {
+	root := t.TempDir()
+	writeMirrorFile(t, root, "v1.0.0", "app.deb", "v1.0.0")
+	m, err := NewMirror(&Config{MirrorURL: root, PackageNamePattern: `.*\.deb$`})
+	assert.NoError(t, err)
+
+	assetID := func() int64 {
+		r, err := m.readReleaseDir("v1.0.0")
+		assert.NoError(t, err)
+		for _, a := range r.assets {
+			if a.name == "app.deb" {
+				return a.id
+			}
+		}
+		t.Fatal("asset not found")
+		return 0
+	}
+	id := assetID()
+	assert.NotZero(t, id)
+
+	// an asset listed before it doesn't change the id
+	writeMirrorFile(t, root, "v1.0.0", "SHA256SUMS", "checksums")
+	assert.Equal(t, id, assetID())
+
+	// the id changes when the asset is replaced
+	writeMirrorFile(t, root, "v1.0.0", "app.deb", "v1.0.0 rebuilt")
+	assert.NotEqual(t, id, assetID())
+}
+
+func TestMirrorMatchedAssetsChanged(t *testing.T) {
+	root := t.TempDir()
+	writeMirrorFile(t, root, "v1.0.0", "app_amd64.deb", "amd64")
+	writeMirrorFile(t, root, "v1.0.0", "app_arm64.deb", "arm64")
+	resolve := func(pattern string) *ReleaseInfo {
+		m, err := NewMirror(&Config{MirrorURL: root, PackageNamePattern: pattern})
+		assert.NoError(t, err)
+		info, err := m.ResolveRelease(context.Background(), "v1.0.0")
+		assert.NoError(t, err)
+		return info
+	}
+
+	// the stable release is saved by the member of another arch
+	stable := resolve(`_arm64\.deb$`)
+	info := resolve(`_amd64\.deb$`)
+	assert.Equal(t, []string{"app_amd64.deb"}, info.Matched)
+	assert.False(t, info.MatchedAssetsChanged(stable))
+
+	// the assets which this member doesn't deploy are ignored
+	writeMirrorFile(t, root, "v1.0.0", "app_arm64.deb", "arm64 rebuilt")
+	writeMirrorFile(t, root, "v1.0.0", "NOTES.md", "notes")
+	info = resolve(`_amd64\.deb$`)
+	assert.NotEqual(t, stable.AssetSet, info.AssetSet)
+	assert.False(t, info.MatchedAssetsChanged(stable))
+
+	writeMirrorFile(t, root, "v1.0.0", "app_amd64.deb", "amd64 rebuilt")
+	assert.True(t, resolve(`_amd64\.deb$`).MatchedAssetsChanged(stable))
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// warn when the remaining budget is lower than this ratio of the limit
+const rateLimitWarningRatio = 0.1
+
+type cachedResponse struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// rateLimitTransport caches API responses by ETag and stops sending requests
+// while the rate limit is exhausted. 304 responses don't count against the rate limit.
+type rateLimitTransport struct {
+	base      http.RoundTripper
+	mu        sync.Mutex
+	cache     map[string]*cachedResponse
+	remaining int
+	reset     time.Time
+	warned    time.Time
+}
+
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{
+		base:      base,
+		cache:     map[string]*cachedResponse{},
+		remaining: -1,
+	}
+}
+
+func cacheKey(req *http.Request) string {
+	return req.Header.Get("Accept") + " " + req.URL.String()
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if t.remaining == 0 && time.Now().Before(t.reset) {
+		reset := t.reset
+		t.mu.Unlock()
+		return nil, errors.Wrap(ErrRateLimited, "wait until "+reset.Format(time.RFC3339))
+	}
+	cached := t.cache[cacheKey(req)]
+	t.mu.Unlock()
+
+	if req.Method == http.MethodGet && cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.updateRateLimit(res)
+
+	if (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests) &&
+		res.Header.Get("X-RateLimit-Remaining") == "0" {
+		res.Body.Close()
+		return nil, errors.Wrap(ErrRateLimited, "wait until "+t.resetTime().Format(time.RFC3339))
+	}
+
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		res.Body.Close()
+		slog.Debug("github api response not modified", "url", req.URL.String())
+		header := cached.header.Clone()
+		for k, v := range res.Header {
+			if strings.HasPrefix(k, "X-Ratelimit-") {
+				header[k] = v
+			}
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         res.Proto,
+			ProtoMajor:    res.ProtoMajor,
+			ProtoMinor:    res.ProtoMinor,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	}
+
+	// only JSON API responses are cached, not the asset bodies
+	etag := res.Header.Get("ETag")
+	if req.Method == http.MethodGet && res.StatusCode == http.StatusOK && etag != "" &&
+		strings.Contains(res.Header.Get("Content-Type"), "json") {
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		t.mu.Lock()
+		t.cache[cacheKey(req)] = &cachedResponse{
+			etag:   etag,
+			header: res.Header.Clone(),
+			body:   body,
+		}
+		t.mu.Unlock()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return res, nil
+}
+
+func (t *rateLimitTransport) resetTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reset
+}
+
+func (t *rateLimitTransport) updateRateLimit(res *http.Response) {
+	remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	limit, _ := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remaining = remaining
+	t.reset = time.Unix(reset, 0)
+
+	if limit > 0 && float64(remaining) < float64(limit)*rateLimitWarningRatio && !t.warned.Equal(t.reset) {
+		slog.Warn("github api rate limit is running low", "remaining", remaining, "limit", limit, "reset", t.reset)
+		t.warned = t.reset
+	}
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tj/assert"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	requests := 0
+	notModified := 0
+	remaining := 4000
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		if remaining == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"tag_name":"v1.0.0"}`)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(nil)}
+	get := func() (string, error) {
+		res, err := client.Get(srv.URL + "/repos/foo/bar/releases/latest")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return string(b), err
+	}
+
+	body, err := get()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"tag_name":"v1.0.0"}`, body)
+
+	// served from the cache by a conditional request
+	body, err = get()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"tag_name":"v1.0.0"}`, body)
+	assert.Equal(t, 1, notModified)
+
+	remaining = 0
+	_, err = get()
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, 3, requests)
+
+	// no request is sent until the limit is reset
+	_, err = get()
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, 3, requests)
+}
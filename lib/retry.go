@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/google/go-github/v55/github"
+	"github.com/pkg/errors"
+)
+
+var errTransient = errors.New("transient error")
+
+const (
+	defaultRequestTimeout  = 30 * time.Second
+	defaultDownloadTimeout = 30 * time.Minute
+)
+
+// first delay of the retry, it is doubled on each attempt up to retryMaxDelay
+var (
+	retryDelay    = time.Second
+	retryMaxDelay = 30 * time.Second
+)
+
+// statusError is the error of an unexpected status code, 5xx is retried as a transient error
+func statusError(method, u string, code int) error {
+	msg := fmt.Sprintf("%s %s returned status: %d", method, u, code)
+	if code >= 500 {
+		return errors.Wrap(errTransient, msg)
+	}
+	return errors.New(msg)
+}
+
+// isTransient reports whether the request may succeed by retrying
+func isTransient(err error) bool {
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, errTransient) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var gerr *github.ErrorResponse
+	if errors.As(err, &gerr) {
+		return gerr.Response != nil && gerr.Response.StatusCode >= 500
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+func (d *assetDownloader) requestTimeout() time.Duration {
+	if d.config.RequestTimeout > 0 {
+		return d.config.RequestTimeout
+	}
+	return defaultRequestTimeout
+}
+
+func (d *assetDownloader) downloadTimeout() time.Duration {
+	if d.config.DownloadTimeout > 0 {
+		return d.config.DownloadTimeout
+	}
+	return defaultDownloadTimeout
+}
+
+// withRetry calls f with the timeout for each attempt(0 means no timeout) and
+// retries the transient errors with backoff until ctx is done
+func (d *assetDownloader) withRetry(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+	attempts := d.config.RequestRetries + 1
+	return retry.Do(
+		func() error {
+			actx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				actx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			err := f(actx)
+			// the attempt is cancelled by the caller, not by its own timeout
+			if err != nil && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		},
+		retry.Context(ctx),
+		retry.Attempts(attempts),
+		retry.Delay(retryDelay),
+		retry.MaxDelay(retryMaxDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(isTransient),
+		retry.OnRetry(func(n uint, err error) {
+			if n+1 < attempts {
+				slog.Warn("release source request failed, retry", "attempt", n+1, slog.String("err", err.Error()))
+			}
+		}),
+	)
+}
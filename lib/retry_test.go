@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tj/assert"
+)
+
+func TestDownloadRetryAndTimeout(t *testing.T) {
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = delay }()
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var indexFailures, assetFailures, ranges int32
+	var stall atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/index.json":
+			if atomic.AddInt32(&indexFailures, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`[{"tag":"v1.0.0","published_at":"2024-01-01T00:00:00Z","assets":[{"name":"app_1.0.0_amd64.deb","size":10000}]}]`))
+		case strings.HasSuffix(r.URL.Path, ".deb"):
+			if stall.Load() {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(10 * time.Second):
+				}
+				return
+			}
+			if r.Header.Get("Range") != "" {
+				atomic.AddInt32(&ranges, 1)
+			}
+			if atomic.AddInt32(&assetFailures, -1) >= 0 {
+				// the connection is closed in the middle of the body
+				w.Header().Set("Content-Length", "10000")
+				w.Write(content[:4000])
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			http.ServeContent(w, r, "app_1.0.0_amd64.deb", time.Time{}, bytes.NewReader(content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	reset := func(index, asset int32) {
+		atomic.StoreInt32(&indexFailures, index)
+		atomic.StoreInt32(&assetFailures, asset)
+		atomic.StoreInt32(&ranges, 0)
+	}
+	newMirror := func(config *Config) *Mirror {
+		config.MirrorURL = srv.URL
+		config.SaveAssetsPath = t.TempDir()
+		config.PackageNamePattern = `\.deb$`
+		m, err := NewMirror(config)
+		assert.NoError(t, err)
+		return m
+	}
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		reset(2, 1)
+		m := newMirror(&Config{RequestRetries: 3})
+
+		_, filename, err := m.DownloadReleaseAsset(context.Background(), LatestTag)
+		assert.NoError(t, err)
+		b, err := os.ReadFile(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, content, b)
+		// the interrupted download is resumed
+		assert.Equal(t, int32(1), atomic.LoadInt32(&ranges))
+	})
+
+	t.Run("no retry", func(t *testing.T) {
+		reset(1, 0)
+		m := newMirror(&Config{})
+
+		_, _, err := m.DownloadReleaseAsset(context.Background(), LatestTag)
+		assert.True(t, errors.Is(err, ErrAssetsCannotDownload))
+	})
+
+	t.Run("stalled download", func(t *testing.T) {
+		reset(0, 0)
+		stall.Store(true)
+		defer stall.Store(false)
+
+		m := newMirror(&Config{RequestRetries: 3, RequestTimeout: time.Minute, DownloadTimeout: 100 * time.Millisecond})
+		start := time.Now()
+		_, _, err := m.DownloadReleaseAsset(context.Background(), LatestTag)
+		assert.True(t, errors.Is(err, ErrAssetsCannotDownload))
+		assert.True(t, time.Since(start) < 5*time.Second)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		reset(0, 0)
+		stall.Store(true)
+		defer stall.Store(false)
+
+		m := newMirror(&Config{RequestRetries: 3})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, _, err := m.DownloadReleaseAsset(ctx, LatestTag)
+		assert.Error(t, err)
+		assert.True(t, time.Since(start) < 5*time.Second)
+	})
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"aead.dev/minisign"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/pkg/errors"
+)
+
+var ErrSignatureInvalid = errors.New("signature invalid")
+
+// detached signature asset suffixes, in order of preference
+var signatureSuffixes = []string{".minisig", ".sig", ".asc"}
+
+type keyring struct {
+	minisignKeys []minisign.PublicKey
+	pgpKeys      openpgp.EntityList
+}
+
+// loadKeyring reads minisign public keys(one per line) or an OpenPGP keyring(armored or binary)
+func loadKeyring(path string) (*keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Contains(b, []byte("-----BEGIN PGP")) {
+		keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyring %s: %s", path, err)
+		}
+		return &keyring{pgpKeys: keys}, nil
+	}
+
+	k := &keyring{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var key minisign.PublicKey
+		if err := key.UnmarshalText([]byte(line)); err != nil {
+			k.minisignKeys = nil
+			break
+		}
+		k.minisignKeys = append(k.minisignKeys, key)
+	}
+	if len(k.minisignKeys) > 0 {
+		return k, nil
+	}
+
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %s", path, err)
+	}
+	return &keyring{pgpKeys: keys}, nil
+}
+
+// verify checks the detached signature of filePath and returns the signer identity
+func (k *keyring) verify(filePath, sigName string, sig []byte) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(sigName, ".minisig") {
+		return k.verifyMinisign(f, sig)
+	}
+	return k.verifyPGP(f, sig)
+}
+
+func (k *keyring) verifyMinisign(f io.Reader, sig []byte) (string, error) {
+	var s minisign.Signature
+	if err := s.UnmarshalText(sig); err != nil {
+		return "", errors.Wrap(ErrSignatureInvalid, err.Error())
+	}
+
+	for _, key := range k.minisignKeys {
+		if key.ID() != s.KeyID {
+			continue
+		}
+
+		ok := false
+		if s.Algorithm == minisign.HashEdDSA {
+			r := minisign.NewReader(f)
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return "", err
+			}
+			ok = r.Verify(key, sig)
+		} else {
+			message, err := io.ReadAll(f)
+			if err != nil {
+				return "", err
+			}
+			ok = minisign.Verify(key, message, sig)
+		}
+		if !ok {
+			return "", errors.Wrap(ErrSignatureInvalid, "minisign signature mismatch")
+		}
+		return fmt.Sprintf("minisign:%s", strings.ToUpper(strconv.FormatUint(key.ID(), 16))), nil
+	}
+	return "", errors.Wrap(ErrSignatureInvalid, fmt.Sprintf("minisign key %X not found in keyring", s.KeyID))
+}
+
+func (k *keyring) verifyPGP(f io.Reader, sig []byte) (string, error) {
+	if len(k.pgpKeys) == 0 {
+		return "", errors.Wrap(ErrSignatureInvalid, "no OpenPGP keys in keyring")
+	}
+
+	var signer *openpgp.Entity
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP")) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(k.pgpKeys, f, bytes.NewReader(sig), nil)
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(k.pgpKeys, f, bytes.NewReader(sig), nil)
+	}
+	if err != nil {
+		return "", errors.Wrap(ErrSignatureInvalid, err.Error())
+	}
+	return fmt.Sprintf("openpgp:%s", signer.PrimaryKey.KeyIdString()), nil
+}
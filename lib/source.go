@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SourceGitHub = "github"
+	SourceGitLab = "gitlab"
+	SourceMirror = "mirror"
+)
+
+// ReleaseSource downloads release assets from a release hosting service
+type ReleaseSource interface {
+	ResolveRelease(ctx context.Context, tag string) (*ReleaseInfo, error)
+	DownloadReleaseAsset(ctx context.Context, tag string) (string, string, error)
+}
+
+// ReleaseInfo is the resolved release metadata which is shared with the fleet
+type ReleaseInfo struct {
+	Tag   string `json:"tag"`
+	Asset string `json:"asset"`
+	Size  int64  `json:"size"`
+	// sha256 of the asset verified at the download, empty until the asset is downloaded
+	Digest string `json:"digest,omitempty"`
+	// id and updated time of the asset to detect re-uploads under the same tag
+	AssetID        int64     `json:"asset_id,omitempty"`
+	AssetUpdatedAt time.Time `json:"asset_updated_at,omitempty"`
+
+	PublishedAt time.Time `json:"published_at"`
+	// fingerprint of all the assets of the release to detect changes
+	AssetSet string `json:"asset_set,omitempty"`
+	// fingerprint of each asset by name and the assets matched by the asset patterns, to detect re-uploads of the deployed assets
+	Fingerprints map[string]string `json:"fingerprints,omitempty"`
+	Matched      []string          `json:"matched,omitempty"`
+	Directives   *Directives       `json:"directives,omitempty"`
+}
+
+// MatchedAssetsChanged reports whether the assets matched by the asset patterns differ from the previous release info.
+// The other assets of the release are ignored, and the whole assets are compared when either info has no fingerprints.
+func (info *ReleaseInfo) MatchedAssetsChanged(prev *ReleaseInfo) bool {
+	if len(info.Fingerprints) == 0 || len(prev.Fingerprints) == 0 || len(info.Matched) == 0 {
+		return info.AssetSet != "" && prev.AssetSet != "" && info.AssetSet != prev.AssetSet
+	}
+	for _, name := range info.Matched {
+		if info.Fingerprints[name] != prev.Fingerprints[name] {
+			return true
+		}
+	}
+	return false
+}
+
+type release struct {
+	tag         string
+	draft       bool
+	prerelease  bool
+	publishedAt time.Time
+	body        string
+	assets      []*releaseAsset
+}
+
+type releaseAsset struct {
+	id        int64
+	name      string
+	size      int64
+	url       string
+	updatedAt time.Time
+}
+
+func (a *releaseAsset) fingerprint() string {
+	return fmt.Sprintf("%d:%s:%d:%d", a.id, a.name, a.size, a.updatedAt.Unix())
+}
+
+// fingerprints returns the fingerprint of each asset of the release by name
+func (r *release) fingerprints() map[string]string {
+	ret := make(map[string]string, len(r.assets))
+	for _, a := range r.assets {
+		ret[a.name] = a.fingerprint()
+	}
+	return ret
+}
+
+// assetSet returns the fingerprint of the assets of the release
+func (r *release) assetSet() string {
+	lines := make([]string, 0, len(r.assets))
+	for _, a := range r.assets {
+		lines = append(lines, a.fingerprint())
+	}
+	sort.Strings(lines)
+
+	h := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// releaseBackend is implemented by each release hosting service
+type releaseBackend interface {
+	latestRelease(ctx context.Context) (*release, error)
+	releaseByTag(ctx context.Context, tag string) (*release, error)
+	listReleases(ctx context.Context) ([]*release, error)
+	// openAsset opens the asset from offset if the backend supports it and returns the actual offset.
+	// The body is read within ctx.
+	openAsset(ctx context.Context, asset *releaseAsset, offset int64) (io.ReadCloser, int64, error)
+}
+
+func NewReleaseSource(config *Config) (ReleaseSource, error) {
+	switch config.Source {
+	case "", SourceGitHub:
+		return NewGitHub(config)
+	case SourceGitLab:
+		return NewGitLab(config)
+	case SourceMirror:
+		return NewMirror(config)
+	}
+	return nil, fmt.Errorf("unknown source: %s", config.Source)
+}
@@ -5,83 +5,130 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
 	"time"
 
-	redis "github.com/redis/go-redis/v9"
+	"github.com/Masterminds/semver/v3"
 )
 
 type State struct {
 	me                  string
-	client              *redis.Client
+	backend             StateBackend
 	canaryReleaseTagKey string
 	stableReleaseTagKey string
 	avoidReleaseTagKey  string
 	membersTagKey       string
 	rolloutKey          string
+	pollerLeaderKey     string
+	releaseInfoKey      string
+	stableReleaseKey    string
+	reuploadAlertKey    string
+	pendingPromotionKey string
+	settlingReleaseKey  string
+	deploymentKey       string
+	canaryPhaseKey      string
 	config              *Config
 }
 
 func NewState(config *Config) (*State, error) {
-	rc := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", config.Redis.Host, config.Redis.Port),
-		Password: config.Redis.Password,
-		DB:       config.Redis.DB,
-	})
-
-	if err := rc.Ping(context.Background()).Err(); err != nil {
-		return nil, fmt.Errorf("failed to create redis client: %s", err)
-	}
-	prefix := config.Repo
-	if config.Redis.KeyPrefix != "" {
-		prefix = config.Redis.KeyPrefix
-	}
-
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get hostname: %s", err)
 	}
 
+	backend, err := newStateBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	prefix := stateKeyPrefix(config)
+
 	return &State{
 		me:                  fmt.Sprintf("%s:%s", hostname, prefix),
-		client:              rc,
+		backend:             backend,
 		config:              config,
 		canaryReleaseTagKey: fmt.Sprintf("%s_canary_release_tag", prefix),
 		stableReleaseTagKey: fmt.Sprintf("%s_stable_release_tag", prefix),
 		avoidReleaseTagKey:  fmt.Sprintf("%s_avoid_release_tag", prefix),
 		membersTagKey:       fmt.Sprintf("%s_members_tag", prefix),
 		rolloutKey:          fmt.Sprintf("%s_rollout", prefix),
+		pollerLeaderKey:     fmt.Sprintf("%s_poller_leader", prefix),
+		releaseInfoKey:      fmt.Sprintf("%s_release_info", prefix),
+		stableReleaseKey:    fmt.Sprintf("%s_stable_release_info", prefix),
+		reuploadAlertKey:    fmt.Sprintf("%s_reupload_alert", prefix),
+		pendingPromotionKey: fmt.Sprintf("%s_pending_promotion", prefix),
+		settlingReleaseKey:  fmt.Sprintf("%s_settling_release", prefix),
+		deploymentKey:       fmt.Sprintf("%s_deployment", prefix),
+		canaryPhaseKey:      fmt.Sprintf("%s:%s_canary_phase", hostname, prefix),
 	}, nil
 }
 
-func (s *State) UnlockCanaryRelease() error {
-	return s.client.Del(context.Background(), s.canaryReleaseTagKey).Err()
+func (s *State) Close() error {
+	return s.backend.Close()
 }
 
-func (s *State) TryCanaryReleaseLock(tag string) (bool, error) {
-	return s.getLock(s.canaryReleaseTagKey, tag, s.config.CanaryRolloutWindow*2)
+// get returns nil when the key doesn't exist
+func (s *State) get(key string) ([]byte, error) {
+	b, err := s.backend.Get(context.Background(), key)
+	if errors.Is(err, ErrStateNotFound) {
+		return nil, nil
+	}
+	return b, err
 }
 
-func (s *State) TryRolloutLock(tag string) (bool, error) {
-	return s.getLock(s.rolloutKey, tag, s.config.RolloutWindow)
+// getJSON reports whether the key exists
+func (s *State) getJSON(key string, v any) (bool, error) {
+	b, err := s.get(key)
+	if err != nil || b == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(b, v)
 }
 
-func (s *State) getLock(key string, tag string, window time.Duration) (bool, error) {
-	ok, err := s.client.SetNX(context.Background(), key, tag, 0).Result()
+func (s *State) setJSON(key string, v any) error {
+	b, err := json.Marshal(v)
 	if err != nil {
-		return false, err
+		return err
 	}
-	if ok {
-		err := s.client.Expire(context.Background(), key, window).Err()
-		if err != nil {
-			return false, err
-		}
-		return true, nil
+	return s.backend.Set(context.Background(), key, b, 0)
+}
+
+// TryCanaryReleaseLock returns the lease of the canary release, nil when another member holds it
+func (s *State) TryCanaryReleaseLock(tag string, window time.Duration) (*Lease, error) {
+	return s.tryLease(s.canaryReleaseTagKey, tag, window*2)
+}
+
+// TryRolloutLock returns the lease of the rollout, nil when another member holds it.
+// The lease isn't released, so that the members roll out one by one in the rollout window.
+func (s *State) TryRolloutLock(tag string) (*Lease, error) {
+	return s.tryLease(s.rolloutKey, tag, s.config.RolloutWindow)
+}
+
+// TryPollerLease acquires or extends the lease of the member polling the release source
+func (s *State) TryPollerLease(lease time.Duration) (bool, error) {
+	ok, err := s.backend.TryLock(context.Background(), s.pollerLeaderKey, s.me, lease)
+	if err != nil || ok {
+		return ok, err
 	}
-	return false, nil
+	return s.backend.ExtendLock(context.Background(), s.pollerLeaderKey, s.me, lease)
 }
+
+func (s *State) PublishReleaseInfo(info *ReleaseInfo) error {
+	return s.setJSON(s.releaseInfoKey, info)
+}
+
+// PublishedReleaseInfo returns the release published by the leader, nil if nothing is published yet
+func (s *State) PublishedReleaseInfo() (*ReleaseInfo, error) {
+	info := &ReleaseInfo{}
+	ok, err := s.getJSON(s.releaseInfoKey, info)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return info, nil
+}
+
 func (s *State) CurrentStableTag() (string, error) {
 	return s.getRelease(s.stableReleaseTagKey)
 }
@@ -94,39 +141,171 @@ func (s *State) IsAvoidReleaseTag(tag string) error {
 }
 
 func (s *State) saveRelease(key, tag string) error {
-	return s.client.Set(context.Background(), key, tag, 0).Err()
+	return s.backend.Set(context.Background(), key, []byte(tag), 0)
 }
 
 func (s *State) saveReleases(key string, tags ...string) error {
-	return s.client.SAdd(context.Background(), key, tags).Err()
+	return s.backend.AddToSet(context.Background(), key, tags...)
 }
 
 func (s *State) SaveStableReleaseTag(tag string) error {
 	return s.saveRelease(s.stableReleaseTagKey, tag)
 }
 
+// SaveStableRelease saves the stable tag with its release info.
+// The directives are honored by the rollout and the assets are compared to detect re-uploads.
+func (s *State) SaveStableRelease(info *ReleaseInfo) error {
+	values, err := s.stableReleaseValues(info)
+	if err != nil {
+		return err
+	}
+	return s.backend.SetAll(context.Background(), values)
+}
+
+func (s *State) stableReleaseValues(info *ReleaseInfo) (map[string][]byte, error) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		s.stableReleaseTagKey: []byte(info.Tag),
+		s.stableReleaseKey:    b,
+	}, nil
+}
+
+// StableRelease returns the release info of the stable tag, nil if it is not saved
+func (s *State) StableRelease() (*ReleaseInfo, error) {
+	info := &ReleaseInfo{}
+	ok, err := s.getJSON(s.stableReleaseKey, info)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return info, nil
+}
+
+const (
+	ReuploadPolicyAlert  = "alert"
+	ReuploadPolicyCanary = "canary"
+)
+
+// MarkReuploadDetected reports whether the re-uploaded assets of the release are detected for the first time
+func (s *State) MarkReuploadDetected(info *ReleaseInfo) (bool, error) {
+	prev, err := s.backend.Swap(context.Background(), s.reuploadAlertKey, []byte(info.Tag+":"+info.AssetSet))
+	if err != nil {
+		return false, err
+	}
+	return string(prev) != info.Tag+":"+info.AssetSet, nil
+}
+
+// ReuploadDetected reports whether the re-uploaded assets of the release are already detected
+func (s *State) ReuploadDetected(info *ReleaseInfo) (bool, error) {
+	b, err := s.get(s.reuploadAlertKey)
+	if err != nil {
+		return false, err
+	}
+	return string(b) == info.Tag+":"+info.AssetSet, nil
+}
+
+var ErrWaitingPromotion = errors.New("waiting for manual promotion")
+
+// PendingPromotion returns the release which passed the canary release and waits for the manual promotion
+func (s *State) PendingPromotion() (*ReleaseInfo, error) {
+	info := &ReleaseInfo{}
+	ok, err := s.getJSON(s.pendingPromotionKey, info)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Promote makes the pending release stable, so that it is rolled out to the fleet
+func (s *State) Promote(tag string) (*ReleaseInfo, error) {
+	info, err := s.PendingPromotion()
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, errors.New("no release is pending promotion")
+	}
+	if tag != "" && tag != info.Tag {
+		return nil, fmt.Errorf("tag:%s is not pending promotion(pending:%s)", tag, info.Tag)
+	}
+
+	if err := s.SaveStableRelease(info); err != nil {
+		return nil, err
+	}
+	return info, s.backend.Delete(context.Background(), s.pendingPromotionKey)
+}
+
+var ErrReleaseSettling = errors.New("waiting for release to settle")
+
+type settlingRelease struct {
+	Tag      string    `json:"tag"`
+	AssetSet string    `json:"asset_set"`
+	Since    time.Time `json:"since"`
+}
+
+// CheckReleaseSettled returns ErrReleaseSettling until minAge passed since the release was published.
+// The wait starts over when the assets of the release are changed during the wait.
+func (s *State) CheckReleaseSettled(info *ReleaseInfo, minAge time.Duration) error {
+	settling := &settlingRelease{}
+	if _, err := s.getJSON(s.settlingReleaseKey, settling); err != nil {
+		return err
+	}
+
+	save := false
+	if settling.Tag != info.Tag {
+		settling = &settlingRelease{
+			Tag:      info.Tag,
+			AssetSet: info.AssetSet,
+			Since:    info.PublishedAt,
+		}
+		save = true
+	} else if settling.AssetSet != info.AssetSet {
+		slog.Warn("assets of the release changed while waiting for release to settle", "tag", info.Tag)
+		settling.AssetSet = info.AssetSet
+		settling.Since = time.Now()
+		save = true
+	}
+
+	if save {
+		if err := s.setJSON(s.settlingReleaseKey, settling); err != nil {
+			return err
+		}
+	}
+
+	if remaining := time.Until(settling.Since.Add(minAge)); remaining > 0 {
+		return fmt.Errorf("%w: tag:%s remaining:%s", ErrReleaseSettling, info.Tag, remaining.Round(time.Second))
+	}
+	return nil
+}
+
 func (s *State) SaveAvoidReleaseTag(tag string) error {
 	return s.saveReleases(s.avoidReleaseTagKey, tag)
 }
 
 func (s *State) getRelease(key string) (string, error) {
-	v, err := s.client.Get(context.Background(), key).Result()
-	if err == redis.Nil {
-		return "", nil
-	}
+	b, err := s.get(key)
 	if err != nil {
 		return "", err
 	}
-	return v, nil
+	return string(b), nil
 }
 
 func (s *State) getReleases(key string) ([]string, error) {
-	return s.client.SMembers(context.Background(), key).Result()
+	return s.backend.SetMembers(context.Background(), key)
 }
 
 var ErrAlreadyInstalled = errors.New("already installed")
+var ErrDowngrade = errors.New("downgrade")
 
 func (s *State) CanInstallTag(tag string) error {
+	return s.CanInstallRelease(&ReleaseInfo{Tag: tag})
+}
+
+// CanInstallRelease is CanInstallTag which also refuses a downgrade by the publish time when the tags aren't semver
+func (s *State) CanInstallRelease(info *ReleaseInfo) error {
+	tag := info.Tag
 	if tag == "" {
 		return errors.New("tag is empty")
 	}
@@ -136,14 +315,18 @@ func (s *State) CanInstallTag(tag string) error {
 		return err
 	}
 
-	if lastInstalledTag == "" {
-		return nil
-	}
-
 	if lastInstalledTag == tag {
 		return ErrAlreadyInstalled
 	}
 
+	if err := s.checkDowngrade(info); err != nil {
+		return err
+	}
+
+	if lastInstalledTag == "" {
+		return nil
+	}
+
 	tags, err := s.getReleases(s.avoidReleaseTagKey)
 	if err != nil {
 		return err
@@ -157,6 +340,42 @@ func (s *State) CanInstallTag(tag string) error {
 	return nil
 }
 
+// checkDowngrade refuses a tag older than the current stable tag unless it is explicitly allowed.
+// The tags are compared as semver, and by the publish time of the releases when either of them isn't semver.
+func (s *State) checkDowngrade(info *ReleaseInfo) error {
+	tag := info.Tag
+	stableTag, err := s.CurrentStableTag()
+	if err != nil {
+		return err
+	}
+
+	if stableTag == "" || stableTag == tag || tag == s.config.AllowDowngradeTo {
+		return nil
+	}
+
+	newer, nerr := semver.NewVersion(tag)
+	stable, serr := semver.NewVersion(stableTag)
+	if nerr == nil && serr == nil {
+		if newer.LessThan(stable) {
+			return fmt.Errorf("%w: tag:%s is older than stable tag:%s", ErrDowngrade, tag, stableTag)
+		}
+		return nil
+	}
+
+	stableInfo, err := s.StableRelease()
+	if err != nil {
+		return err
+	}
+	if stableInfo == nil || stableInfo.Tag != stableTag || stableInfo.PublishedAt.IsZero() || info.PublishedAt.IsZero() {
+		slog.Debug("can't compare version", "tag", tag, "stable", stableTag)
+		return nil
+	}
+	if info.PublishedAt.Before(stableInfo.PublishedAt) {
+		return fmt.Errorf("%w: tag:%s is published before stable tag:%s", ErrDowngrade, tag, stableTag)
+	}
+	return nil
+}
+
 func (s *State) GetLastInstalledTag() (string, error) {
 	out, err := exec.Command("sh", "-c", s.config.VersionCommand).Output()
 	if err != nil {
@@ -187,9 +406,6 @@ type MemberState struct {
 }
 
 func (s *State) SaveMemberState() error {
-	pipe := s.client.Pipeline()
-
-	pipe.SAdd(context.Background(), s.membersTagKey, s.me).Err()
 	currentVersion, err := s.GetLastInstalledTag()
 	if err != nil {
 		return err
@@ -203,39 +419,103 @@ func (s *State) SaveMemberState() error {
 	if err != nil {
 		return err
 	}
-	pipe.SetEx(context.Background(), s.me, b, s.config.RolloutWindow*2)
-	if _, err := pipe.Exec(context.Background()); err != nil {
+	if err := s.backend.AddToSet(context.Background(), s.membersTagKey, s.me); err != nil {
 		return err
 	}
-	return nil
+	return s.backend.Set(context.Background(), s.me, b, s.config.RolloutWindow*2)
 }
 
 func (s *State) GetRolloutProgress(tag string) (int, int, error) {
-	members := s.client.SMembers(context.Background(), s.membersTagKey).Val()
+	members, err := s.backend.SetMembers(context.Background(), s.membersTagKey)
+	if err != nil {
+		return 0, 0, err
+	}
 	all := len(members)
 	deletedMembers := make([]string, 0, all)
 	installed := 0
 	for _, m := range members {
-		b, err := s.client.Get(context.Background(), m).Bytes()
+		ms := &MemberState{}
+		ok, err := s.getJSON(m, ms)
 		if err != nil {
-			if err == redis.Nil {
-				deletedMembers = append(deletedMembers, m)
-				continue
-			}
 			return 0, 0, err
 		}
-		ms := &MemberState{}
-		if err := json.Unmarshal(b, ms); err != nil {
-			return 0, 0, err
+		if !ok {
+			deletedMembers = append(deletedMembers, m)
+			continue
 		}
 		if ms.CurrentVersion == tag {
 			installed++
 		}
 	}
 	if len(deletedMembers) > 0 {
-		if err := s.client.SRem(context.Background(), s.membersTagKey, deletedMembers).Err(); err != nil {
+		if err := s.backend.RemoveFromSet(context.Background(), s.membersTagKey, deletedMembers...); err != nil {
 			return 0, 0, err
 		}
 	}
 	return installed, all, nil
 }
+
+type deploymentRecord struct {
+	Tag string `json:"tag"`
+	ID  int64  `json:"id"`
+}
+
+// SaveDeployment records the GitHub deployment of the tag, so that the members report the rollout to it
+func (s *State) SaveDeployment(tag string, id int64) error {
+	return s.setJSON(s.deploymentKey, &deploymentRecord{Tag: tag, ID: id})
+}
+
+// DeploymentID returns the GitHub deployment of the tag, 0 if it isn't created
+func (s *State) DeploymentID(tag string) (int64, error) {
+	record := &deploymentRecord{}
+	ok, err := s.getJSON(s.deploymentKey, record)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if record.Tag != tag {
+		return 0, nil
+	}
+	return record.ID, nil
+}
+
+const (
+	CanaryPhaseDeploying   = "canary-deploying"
+	CanaryPhaseChecking    = "canary-checking"
+	CanaryPhaseRollingBack = "rolling-back"
+	// the rollback failed and manual recovery is required, it is reported on startup but never retried
+	CanaryPhaseRollbackFailed = "rollback-failed"
+)
+
+// CanaryRecord is the phase of the canary release running on this member.
+// It survives a crash or a reboot, so that the canary release is resumed or rolled back on startup.
+type CanaryRecord struct {
+	Phase       string        `json:"phase"`
+	Release     *ReleaseInfo  `json:"release"`
+	PreviousTag string        `json:"previous_tag"`
+	Reupload    bool          `json:"reupload"`
+	Window      time.Duration `json:"window"`
+	File        string        `json:"file"`
+	// Since is the start of the phase, the health check started at it in canary-checking
+	Since time.Time `json:"since"`
+}
+
+// SaveCanaryPhase moves the canary release of this member to the phase
+func (s *State) SaveCanaryPhase(record *CanaryRecord, phase string) error {
+	record.Phase = phase
+	record.Since = time.Now()
+	return s.setJSON(s.canaryPhaseKey, record)
+}
+
+// CanaryRecord returns the canary release left by this member, nil if it is finished
+func (s *State) CanaryRecord() (*CanaryRecord, error) {
+	record := &CanaryRecord{}
+	ok, err := s.getJSON(s.canaryPhaseKey, record)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *State) ClearCanaryRecord() error {
+	return s.backend.Delete(context.Background(), s.canaryPhaseKey)
+}
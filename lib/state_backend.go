@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	StateBackendRedis  = "redis"
+	StateBackendEtcd   = "etcd"
+	StateBackendConsul = "consul"
+	StateBackendFile   = "file"
+)
+
+var ErrStateNotFound = errors.New("state not found")
+
+// bounds an operation of the etcd, the consul and the file backends, the redis client has its own timeouts
+const stateBackendTimeout = 10 * time.Second
+
+// StateBackend stores the state shared by the members: the locks, the stable and avoid tags and the member states.
+// Values are opaque to the backend and a ttl of 0 means the key never expires.
+type StateBackend interface {
+	// Get returns ErrStateNotFound when the key doesn't exist
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetAll sets all the values atomically
+	SetAll(ctx context.Context, values map[string][]byte) error
+	// Swap sets the value and returns the previous one, nil when the key didn't exist
+	Swap(ctx context.Context, key string, value []byte) ([]byte, error)
+	Delete(ctx context.Context, keys ...string) error
+
+	// TryLock sets the holder to the key only when the key doesn't exist, the lock is released after the ttl
+	TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// ExtendLock renews the ttl of the lock only when the holder still holds it
+	ExtendLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Unlock deletes the lock only when the holder still holds it
+	Unlock(ctx context.Context, key, holder string) (bool, error)
+	// Incr increments the counter of the key atomically and returns the new value, the counter starts at 0
+	Incr(ctx context.Context, key string) (int64, error)
+	// SetAllIfLocked sets the values and adds the members to the sets atomically only when the holder still holds the lock
+	SetAllIfLocked(ctx context.Context, lockKey, holder string, values map[string][]byte, members map[string][]string) (bool, error)
+
+	AddToSet(ctx context.Context, key string, members ...string) error
+	SetMembers(ctx context.Context, key string) ([]string, error)
+	RemoveFromSet(ctx context.Context, key string, members ...string) error
+
+	Close() error
+}
+
+func newStateBackend(config *Config) (StateBackend, error) {
+	switch config.StateBackend {
+	case "", StateBackendRedis:
+		return newRedisBackend(config.Redis)
+	case StateBackendEtcd:
+		return newEtcdBackend(config.Etcd)
+	case StateBackendConsul:
+		return newConsulBackend(config.Consul)
+	case StateBackendFile:
+		return newFileBackend(config.FileState)
+	}
+	return nil, fmt.Errorf("unknown state backend: %s", config.StateBackend)
+}
+
+// stateKeyPrefix returns the key prefix of the backend, the repo name by default
+func stateKeyPrefix(config *Config) string {
+	prefix := ""
+	switch config.StateBackend {
+	case "", StateBackendRedis:
+		if config.Redis != nil {
+			prefix = config.Redis.KeyPrefix
+			if config.Redis.isCluster() {
+				// all the keys are in the same slot, so that they can be updated in a transaction
+				if prefix == "" {
+					prefix = config.Repo
+				}
+				return "{" + prefix + "}"
+			}
+		}
+	case StateBackendEtcd:
+		if config.Etcd != nil {
+			prefix = config.Etcd.KeyPrefix
+		}
+	case StateBackendConsul:
+		if config.Consul != nil {
+			prefix = config.Consul.KeyPrefix
+		}
+	case StateBackendFile:
+		if config.FileState != nil {
+			prefix = config.FileState.KeyPrefix
+		}
+	}
+	if prefix == "" {
+		return config.Repo
+	}
+	return prefix
+}
+
+func withStateTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, stateBackendTimeout)
+}
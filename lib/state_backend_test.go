@@ -0,0 +1,322 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/tj/assert"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// testStateBackend is the conformance suite which all the state backends must pass.
+// expires is false for the backends whose ttl is too long to wait in a test.
+func testStateBackend(t *testing.T, config *Config, expires bool) {
+	config.Repo = fmt.Sprintf("%s_%d", t.Name(), time.Now().UnixNano())
+	backend, err := newStateBackend(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	defer backend.Close()
+
+	ctx := context.Background()
+	key := func(name string) string {
+		return config.Repo + "_" + name
+	}
+
+	t.Run("get and set", func(t *testing.T) {
+		_, err := backend.Get(ctx, key("missing"))
+		assert.True(t, errors.Is(err, ErrStateNotFound))
+
+		assert.NoError(t, backend.Set(ctx, key("value"), []byte("v1"), 0))
+		b, err := backend.Get(ctx, key("value"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v1", string(b))
+
+		assert.NoError(t, backend.SetAll(ctx, map[string][]byte{
+			key("value"):  []byte("v2"),
+			key("value2"): []byte("v3"),
+		}))
+		b, err = backend.Get(ctx, key("value"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v2", string(b))
+		b, err = backend.Get(ctx, key("value2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v3", string(b))
+
+		assert.NoError(t, backend.Delete(ctx, key("value"), key("value2"), key("missing")))
+		_, err = backend.Get(ctx, key("value"))
+		assert.True(t, errors.Is(err, ErrStateNotFound))
+		_, err = backend.Get(ctx, key("value2"))
+		assert.True(t, errors.Is(err, ErrStateNotFound))
+	})
+
+	t.Run("swap", func(t *testing.T) {
+		prev, err := backend.Swap(ctx, key("swap"), []byte("v1"))
+		assert.NoError(t, err)
+		assert.Nil(t, prev)
+
+		prev, err = backend.Swap(ctx, key("swap"), []byte("v2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v1", string(prev))
+	})
+
+	t.Run("lock", func(t *testing.T) {
+		ok, err := backend.TryLock(ctx, key("lock"), "a", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = backend.TryLock(ctx, key("lock"), "b", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = backend.ExtendLock(ctx, key("lock"), "a", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = backend.ExtendLock(ctx, key("lock"), "b", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		b, err := backend.Get(ctx, key("lock"))
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(b))
+
+		assert.NoError(t, backend.Delete(ctx, key("lock")))
+		ok, err = backend.ExtendLock(ctx, key("lock"), "a", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = backend.TryLock(ctx, key("lock"), "b", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = backend.Unlock(ctx, key("lock"), "a")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = backend.Unlock(ctx, key("lock"), "b")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		_, err = backend.Get(ctx, key("lock"))
+		assert.True(t, errors.Is(err, ErrStateNotFound))
+	})
+
+	t.Run("incr", func(t *testing.T) {
+		for i := int64(1); i <= 3; i++ {
+			n, err := backend.Incr(ctx, key("counter"))
+			assert.NoError(t, err)
+			assert.Equal(t, i, n)
+		}
+	})
+
+	t.Run("set if locked", func(t *testing.T) {
+		values := map[string][]byte{key("fenced"): []byte("v1")}
+		members := map[string][]string{key("fenced_set"): {"a", "b"}}
+		ok, err := backend.SetAllIfLocked(ctx, key("fence"), "a", values, members)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		_, err = backend.Get(ctx, key("fenced"))
+		assert.True(t, errors.Is(err, ErrStateNotFound))
+
+		ok, err = backend.TryLock(ctx, key("fence"), "a", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = backend.SetAllIfLocked(ctx, key("fence"), "b", values, members)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = backend.SetAllIfLocked(ctx, key("fence"), "a", values, members)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		b, err := backend.Get(ctx, key("fenced"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v1", string(b))
+		m, err := backend.SetMembers(ctx, key("fenced_set"))
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, m)
+	})
+
+	t.Run("set", func(t *testing.T) {
+		members, err := backend.SetMembers(ctx, key("set"))
+		assert.NoError(t, err)
+		assert.Empty(t, members)
+
+		assert.NoError(t, backend.AddToSet(ctx, key("set"), "a", "host:foo/bar"))
+		assert.NoError(t, backend.AddToSet(ctx, key("set"), "a"))
+		members, err = backend.SetMembers(ctx, key("set"))
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "host:foo/bar"}, members)
+
+		assert.NoError(t, backend.RemoveFromSet(ctx, key("set"), "a", "missing"))
+		members, err = backend.SetMembers(ctx, key("set"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"host:foo/bar"}, members)
+	})
+
+	t.Run("ttl is cleared by set", func(t *testing.T) {
+		assert.NoError(t, backend.Set(ctx, key("ttl"), []byte("v1"), time.Second))
+		assert.NoError(t, backend.Set(ctx, key("ttl"), []byte("v2"), 0))
+		if expires {
+			time.Sleep(2500 * time.Millisecond)
+		}
+		b, err := backend.Get(ctx, key("ttl"))
+		assert.NoError(t, err)
+		assert.Equal(t, "v2", string(b))
+	})
+
+	if expires {
+		t.Run("expire", func(t *testing.T) {
+			assert.NoError(t, backend.Set(ctx, key("expire"), []byte("v1"), time.Second))
+			ok, err := backend.TryLock(ctx, key("expire_lock"), "a", time.Second)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			time.Sleep(2500 * time.Millisecond)
+			_, err = backend.Get(ctx, key("expire"))
+			assert.True(t, errors.Is(err, ErrStateNotFound))
+			ok, err = backend.ExtendLock(ctx, key("expire_lock"), "a", time.Second)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			ok, err = backend.TryLock(ctx, key("expire_lock"), "b", time.Second)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+
+	t.Run("state", func(t *testing.T) {
+		config.VersionCommand = "echo v1.0.0"
+		config.RolloutWindow = time.Minute
+		state, err := NewState(config)
+		assert.NoError(t, err)
+		defer state.Close()
+
+		assert.NoError(t, state.SaveStableRelease(&ReleaseInfo{Tag: "v1.0.0", Asset: "app.deb"}))
+		tag, err := state.CurrentStableTag()
+		assert.NoError(t, err)
+		assert.Equal(t, "v1.0.0", tag)
+		info, err := state.StableRelease()
+		assert.NoError(t, err)
+		assert.Equal(t, "app.deb", info.Asset)
+
+		assert.NoError(t, state.SaveAvoidReleaseTag("v1.1.0"))
+		assert.Equal(t, ErrAvoidReleaseTag, state.CanInstallTag("v1.1.0"))
+		assert.NoError(t, state.CanInstallTag("v1.2.0"))
+
+		assert.NoError(t, state.SaveMemberState())
+		installed, all, err := state.GetRolloutProgress("v1.0.0")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, installed)
+		assert.Equal(t, 1, all)
+
+		lease, err := state.TryCanaryReleaseLock("v1.2.0", time.Minute)
+		assert.NoError(t, err)
+		assert.NotNil(t, lease)
+		other, err := state.TryCanaryReleaseLock("v1.2.0", time.Minute)
+		assert.NoError(t, err)
+		assert.Nil(t, other)
+		assert.NoError(t, lease.Release())
+		other, err = state.TryCanaryReleaseLock("v1.2.0", time.Minute)
+		assert.NoError(t, err)
+		assert.NotNil(t, other)
+		assert.Greater(t, other.Token, lease.Token)
+	})
+}
+
+func TestRedisBackend(t *testing.T) {
+	config := newTestConfig()
+	config.Redis.KeyPrefix = ""
+	testStateBackend(t, config, true)
+}
+
+// freeURL returns the url of a port which is free now
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestEtcdBackend(t *testing.T) {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls = []url.URL{client}
+	cfg.AdvertiseClientUrls = []url.URL{client}
+	cfg.ListenPeerUrls = []url.URL{peer}
+	cfg.AdvertisePeerUrls = []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+	defer e.Close()
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd is not ready")
+	}
+
+	config := newTestConfig()
+	config.StateBackend = StateBackendEtcd
+	config.Etcd = &EtcdConfig{Endpoints: []string{client.Host}}
+	testStateBackend(t, config, true)
+}
+
+func TestConsulBackend(t *testing.T) {
+	if _, err := exec.LookPath("consul"); err != nil {
+		t.Skip("consul is not installed")
+	}
+	srv, err := testutil.NewTestServerConfigT(t, func(c *testutil.TestServerConfig) {
+		c.LogLevel = "error"
+	})
+	if err != nil {
+		t.Fatalf("failed to start consul: %v", err)
+	}
+	defer srv.Stop()
+
+	config := newTestConfig()
+	config.StateBackend = StateBackendConsul
+	config.Consul = &ConsulConfig{Address: srv.HTTPAddr}
+	// consul invalidates a session 10s-20s later at the earliest
+	testStateBackend(t, config, false)
+}
+
+func TestFileBackend(t *testing.T) {
+	config := newTestConfig()
+	config.StateBackend = StateBackendFile
+	config.FileState = &FileStateConfig{Dir: t.TempDir()}
+	testStateBackend(t, config, true)
+}
+
+func TestFileBackendLock(t *testing.T) {
+	dir := t.TempDir()
+	results := make(chan bool, 10)
+	for i := 0; i < cap(results); i++ {
+		go func(holder string) {
+			// the backends don't share anything but the files
+			backend, err := newFileBackend(&FileStateConfig{Dir: dir})
+			assert.NoError(t, err)
+			ok, err := backend.TryLock(context.Background(), "lock", holder, time.Minute)
+			assert.NoError(t, err)
+			results <- ok
+		}(fmt.Sprint(i))
+	}
+
+	locked := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results {
+			locked++
+		}
+	}
+	assert.Equal(t, 1, locked)
+}
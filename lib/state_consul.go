@@ -0,0 +1,367 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// consul limits the ttl of a session between 10s and 24h
+	consulMinSessionTTL = 10 * time.Second
+	consulMaxSessionTTL = 24 * time.Hour
+	// consul limits the number of the operations in a transaction
+	consulMaxTxnOps = 64
+)
+
+// consulBackend expires the keys by the sessions which delete the keys held by them on invalidation.
+// Consul invalidates a session up to twice the ttl later.
+type consulBackend struct {
+	client *api.Client
+}
+
+func newConsulBackend(config *ConsulConfig) (*consulBackend, error) {
+	c := api.DefaultConfig()
+	if config != nil {
+		if config.Address != "" {
+			c.Address = config.Address
+		}
+		if config.Token != "" {
+			c.Token = config.Token
+		}
+		if config.Datacenter != "" {
+			c.Datacenter = config.Datacenter
+		}
+	}
+	client, err := api.NewClient(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul client: %s", err)
+	}
+
+	ctx, cancel := withStateTimeout(context.Background())
+	defer cancel()
+	if _, err := client.Status().LeaderWithQueryOptions((&api.QueryOptions{}).WithContext(ctx)); err != nil {
+		return nil, fmt.Errorf("failed to connect consul: %s", err)
+	}
+	return &consulBackend{client: client}, nil
+}
+
+func consulSessionTTL(ttl time.Duration) time.Duration {
+	return min(max(ttl, consulMinSessionTTL), consulMaxSessionTTL).Round(time.Second)
+}
+
+// session creates the session deleting the keys held by it after the ttl
+func (c *consulBackend) session(ctx context.Context, ttl time.Duration) (string, error) {
+	id, _, err := c.client.Session().CreateNoChecks(&api.SessionEntry{
+		Name:     "gacr",
+		Behavior: api.SessionBehaviorDelete,
+		TTL:      consulSessionTTL(ttl).String(),
+		// the lock can be acquired again as soon as the session is invalidated
+		LockDelay: time.Millisecond,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	return id, err
+}
+
+// destroy drops the session which no longer holds the key
+func (c *consulBackend) destroy(ctx context.Context, id string) {
+	if id == "" {
+		return
+	}
+	// the session expires by itself when it can't be destroyed
+	_, _ = c.client.Session().Destroy(id, (&api.WriteOptions{}).WithContext(ctx))
+}
+
+func (c *consulBackend) txn(ctx context.Context, ops api.TxnOps) (bool, *api.TxnResponse, error) {
+	ok, res, _, err := c.client.Txn().Txn(ops, (&api.QueryOptions{}).WithContext(ctx))
+	return ok, res, err
+}
+
+// commit runs the operations in transactions of the max size
+func (c *consulBackend) commit(ctx context.Context, ops api.TxnOps) error {
+	for len(ops) > 0 {
+		n := min(len(ops), consulMaxTxnOps)
+		ok, res, err := c.txn(ctx, ops[:n])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("consul transaction failed: %v", res.Errors)
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+func (c *consulBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	pair, _, err := c.client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, ErrStateNotFound
+	}
+	return pair.Value, nil
+}
+
+func (c *consulBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	prev, _, err := c.client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	// the key is deleted first to release the session holding it
+	ops := api.TxnOps{{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: key}}}
+	session := ""
+	if ttl > 0 {
+		session, err = c.session(ctx, ttl)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVLock, Key: key, Value: value, Session: session}})
+	} else {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value}})
+	}
+
+	if err := c.commit(ctx, ops); err != nil {
+		c.destroy(ctx, session)
+		return err
+	}
+	if prev != nil && prev.Session != session {
+		c.destroy(ctx, prev.Session)
+	}
+	return nil
+}
+
+func (c *consulBackend) SetAll(ctx context.Context, values map[string][]byte) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make(api.TxnOps, 0, len(values))
+	for k, v := range values {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: k, Value: v}})
+	}
+	ok, res, err := c.txn(ctx, ops)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("consul transaction failed: %v", res.Errors)
+	}
+	return nil
+}
+
+func (c *consulBackend) Swap(ctx context.Context, key string, value []byte) ([]byte, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ok, res, err := c.txn(ctx, api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVGetOrEmpty, Key: key}},
+		{KV: &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: value}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("consul transaction failed: %v", res.Errors)
+	}
+	if prev := res.Results[0].KV; prev != nil && prev.ModifyIndex != 0 {
+		return prev.Value, nil
+	}
+	return nil, nil
+}
+
+func (c *consulBackend) Delete(ctx context.Context, keys ...string) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make(api.TxnOps, 0, len(keys))
+	for _, k := range keys {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: k}})
+	}
+	return c.commit(ctx, ops)
+}
+
+func (c *consulBackend) TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := api.TxnOps{{KV: &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: key}}}
+	session := ""
+	if ttl > 0 {
+		var err error
+		session, err = c.session(ctx, ttl)
+		if err != nil {
+			return false, err
+		}
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVLock, Key: key, Value: []byte(holder), Session: session}})
+	} else {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: key, Value: []byte(holder)}})
+	}
+
+	ok, _, err := c.txn(ctx, ops)
+	if err != nil || !ok {
+		c.destroy(ctx, session)
+		return false, err
+	}
+	return true, nil
+}
+
+// ExtendLock renews the session holding the lock, the ttl of the session is kept
+func (c *consulBackend) ExtendLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	pair, _, err := c.client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	if pair == nil || string(pair.Value) != holder || pair.Session == "" {
+		return false, nil
+	}
+
+	// the renewal fails when the session is already invalidated and the lock is released
+	entry, _, err := c.client.Session().Renew(pair.Session, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	return entry != nil, nil
+}
+
+func (c *consulBackend) Unlock(ctx context.Context, key, holder string) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	pair, _, err := c.client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	if pair == nil || string(pair.Value) != holder {
+		return false, nil
+	}
+
+	ok, _, err := c.client.KV().DeleteCAS(pair, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil || !ok {
+		return false, err
+	}
+	c.destroy(ctx, pair.Session)
+	return true, nil
+}
+
+// Incr retries the increment until no one else updates the counter in between
+func (c *consulBackend) Incr(ctx context.Context, key string) (int64, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	for {
+		pair, _, err := c.client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		// the index 0 creates the key only when it doesn't exist
+		next := &api.KVPair{Key: key}
+		if pair != nil {
+			n, err = strconv.ParseInt(string(pair.Value), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid counter %s: %s", key, err)
+			}
+			next.ModifyIndex = pair.ModifyIndex
+		}
+		n++
+		next.Value = []byte(strconv.FormatInt(n, 10))
+
+		ok, _, err := c.client.KV().CAS(next, (&api.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return n, nil
+		}
+	}
+}
+
+// SetAllIfLocked checks the index of the lock in the transaction, so that the lock isn't taken over in between
+func (c *consulBackend) SetAllIfLocked(ctx context.Context, lockKey, holder string, values map[string][]byte, members map[string][]string) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	pair, _, err := c.client.KV().Get(lockKey, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	if pair == nil || string(pair.Value) != holder {
+		return false, nil
+	}
+
+	ops := api.TxnOps{{KV: &api.KVTxnOp{Verb: api.KVCheckIndex, Key: lockKey, Index: pair.ModifyIndex}}}
+	for k, v := range values {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: k, Value: v}})
+	}
+	for k, ms := range members {
+		for _, m := range ms {
+			ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: consulSetPrefix(k) + m}})
+		}
+	}
+	ok, _, err := c.txn(ctx, ops)
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// the members of a set are stored as the keys under the set
+func consulSetPrefix(key string) string {
+	return key + "/"
+}
+
+func (c *consulBackend) AddToSet(ctx context.Context, key string, members ...string) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make(api.TxnOps, 0, len(members))
+	for _, m := range members {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: consulSetPrefix(key) + m}})
+	}
+	return c.commit(ctx, ops)
+}
+
+func (c *consulBackend) SetMembers(ctx context.Context, key string) ([]string, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	keys, _, err := c.client.KV().Keys(consulSetPrefix(key), "", (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(keys))
+	for _, k := range keys {
+		members = append(members, strings.TrimPrefix(k, consulSetPrefix(key)))
+	}
+	return members, nil
+}
+
+func (c *consulBackend) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make(api.TxnOps, 0, len(members))
+	for _, m := range members {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: consulSetPrefix(key) + m}})
+	}
+	return c.commit(ctx, ops)
+}
+
+// Close does nothing, the consul client has no connection to close
+func (c *consulBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,314 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcd limits the number of the operations in a transaction(--max-txn-ops)
+const etcdMaxTxnOps = 128
+
+type etcdBackend struct {
+	client *clientv3.Client
+}
+
+func newEtcdBackend(config *EtcdConfig) (*etcdBackend, error) {
+	if config == nil || len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd endpoints are not configured")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   config.Endpoints,
+		Username:    config.Username,
+		Password:    config.Password,
+		DialTimeout: stateBackendTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %s", err)
+	}
+
+	ctx, cancel := withStateTimeout(context.Background())
+	defer cancel()
+	if _, err := client.Status(ctx, config.Endpoints[0]); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect etcd: %s", err)
+	}
+	return &etcdBackend{client: client}, nil
+}
+
+// etcdLeaseTTL rounds up the ttl to seconds, the unit of etcd leases
+func etcdLeaseTTL(ttl time.Duration) int64 {
+	sec := int64((ttl + time.Second - 1) / time.Second)
+	if sec < 1 {
+		return 1
+	}
+	return sec
+}
+
+// grant returns the put options attaching the key to a new lease of the ttl
+func (e *etcdBackend) grant(ctx context.Context, ttl time.Duration) ([]clientv3.OpOption, clientv3.LeaseID, error) {
+	if ttl <= 0 {
+		return nil, clientv3.NoLease, nil
+	}
+	lease, err := e.client.Grant(ctx, etcdLeaseTTL(ttl))
+	if err != nil {
+		return nil, clientv3.NoLease, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease.ID)}, lease.ID, nil
+}
+
+// revoke drops the lease which no longer has the key
+func (e *etcdBackend) revoke(ctx context.Context, id clientv3.LeaseID) {
+	if id == clientv3.NoLease {
+		return
+	}
+	// the lease expires by itself when it can't be revoked
+	_, _ = e.client.Revoke(ctx, id)
+}
+
+func (e *etcdBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	res, err := e.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Kvs) == 0 {
+		return nil, ErrStateNotFound
+	}
+	return res.Kvs[0].Value, nil
+}
+
+func (e *etcdBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	opts, lease, err := e.grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Put(ctx, key, string(value), append(opts, clientv3.WithPrevKV())...)
+	if err != nil {
+		e.revoke(ctx, lease)
+		return err
+	}
+	if res.PrevKv != nil && clientv3.LeaseID(res.PrevKv.Lease) != lease {
+		e.revoke(ctx, clientv3.LeaseID(res.PrevKv.Lease))
+	}
+	return nil
+}
+
+func (e *etcdBackend) SetAll(ctx context.Context, values map[string][]byte) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make([]clientv3.Op, 0, len(values))
+	for k, v := range values {
+		ops = append(ops, clientv3.OpPut(k, string(v)))
+	}
+	_, err := e.client.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+func (e *etcdBackend) Swap(ctx context.Context, key string, value []byte) ([]byte, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	res, err := e.client.Put(ctx, key, string(value), clientv3.WithPrevKV())
+	if err != nil {
+		return nil, err
+	}
+	if res.PrevKv == nil {
+		return nil, nil
+	}
+	return res.PrevKv.Value, nil
+}
+
+func (e *etcdBackend) Delete(ctx context.Context, keys ...string) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make([]clientv3.Op, 0, len(keys))
+	for _, k := range keys {
+		ops = append(ops, clientv3.OpDelete(k))
+	}
+	return e.commit(ctx, ops)
+}
+
+// commit runs the operations in transactions of the max size
+func (e *etcdBackend) commit(ctx context.Context, ops []clientv3.Op) error {
+	for len(ops) > 0 {
+		n := min(len(ops), etcdMaxTxnOps)
+		if _, err := e.client.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+func (e *etcdBackend) TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	opts, lease, err := e.grant(ctx, ttl)
+	if err != nil {
+		return false, err
+	}
+	res, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, holder, opts...)).
+		Commit()
+	if err != nil || !res.Succeeded {
+		e.revoke(ctx, lease)
+		return false, err
+	}
+	return true, nil
+}
+
+// ExtendLock moves the lock to a new lease of the ttl, the lease of etcd can't change its ttl
+func (e *etcdBackend) ExtendLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	opts, lease, err := e.grant(ctx, ttl)
+	if err != nil {
+		return false, err
+	}
+	res, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", holder)).
+		Then(clientv3.OpPut(key, holder, append(opts, clientv3.WithPrevKV())...)).
+		Commit()
+	if err != nil || !res.Succeeded {
+		e.revoke(ctx, lease)
+		return false, err
+	}
+	if put := res.Responses[0].GetResponsePut(); put != nil && put.PrevKv != nil {
+		e.revoke(ctx, clientv3.LeaseID(put.PrevKv.Lease))
+	}
+	return true, nil
+}
+
+func (e *etcdBackend) Unlock(ctx context.Context, key, holder string) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	res, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", holder)).
+		Then(clientv3.OpDelete(key, clientv3.WithPrevKV())).
+		Commit()
+	if err != nil || !res.Succeeded {
+		return false, err
+	}
+	if del := res.Responses[0].GetResponseDeleteRange(); del != nil && len(del.PrevKvs) > 0 {
+		e.revoke(ctx, clientv3.LeaseID(del.PrevKvs[0].Lease))
+	}
+	return true, nil
+}
+
+// Incr retries the increment until no one else updates the counter in between
+func (e *etcdBackend) Incr(ctx context.Context, key string) (int64, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	for {
+		res, err := e.client.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		var n, rev int64
+		if len(res.Kvs) > 0 {
+			n, err = strconv.ParseInt(string(res.Kvs[0].Value), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid counter %s: %s", key, err)
+			}
+			rev = res.Kvs[0].ModRevision
+		}
+		n++
+
+		txn, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, strconv.FormatInt(n, 10))).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txn.Succeeded {
+			return n, nil
+		}
+	}
+}
+
+func (e *etcdBackend) SetAllIfLocked(ctx context.Context, lockKey, holder string, values map[string][]byte, members map[string][]string) (bool, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make([]clientv3.Op, 0, len(values)+len(members))
+	for k, v := range values {
+		ops = append(ops, clientv3.OpPut(k, string(v)))
+	}
+	for k, ms := range members {
+		for _, m := range ms {
+			ops = append(ops, clientv3.OpPut(etcdSetPrefix(k)+m, ""))
+		}
+	}
+	res, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(lockKey), "=", holder)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return res.Succeeded, nil
+}
+
+// the members of a set are stored as the keys under the set
+func etcdSetPrefix(key string) string {
+	return key + "/"
+}
+
+func (e *etcdBackend) AddToSet(ctx context.Context, key string, members ...string) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make([]clientv3.Op, 0, len(members))
+	for _, m := range members {
+		ops = append(ops, clientv3.OpPut(etcdSetPrefix(key)+m, ""))
+	}
+	return e.commit(ctx, ops)
+}
+
+func (e *etcdBackend) SetMembers(ctx context.Context, key string) ([]string, error) {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	res, err := e.client.Get(ctx, etcdSetPrefix(key), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(res.Kvs))
+	for _, kv := range res.Kvs {
+		members = append(members, strings.TrimPrefix(string(kv.Key), etcdSetPrefix(key)))
+	}
+	return members, nil
+}
+
+func (e *etcdBackend) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	ops := make([]clientv3.Op, 0, len(members))
+	for _, m := range members {
+		ops = append(ops, clientv3.OpDelete(etcdSetPrefix(key)+m))
+	}
+	return e.commit(ctx, ops)
+}
+
+func (e *etcdBackend) Close() error {
+	return e.client.Close()
+}
@@ -0,0 +1,333 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultFileStateDir = "/var/lib/gacr"
+	fileStateName       = "state.json"
+	fileStateLockName   = "state.lock"
+)
+
+type fileStateValue struct {
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (v *fileStateValue) expired(now time.Time) bool {
+	return v.ExpiresAt != nil && !now.Before(*v.ExpiresAt)
+}
+
+type fileState struct {
+	Values map[string]*fileStateValue `json:"values"`
+	Sets   map[string][]string        `json:"sets"`
+}
+
+// get returns nil when the key doesn't exist or is expired
+func (f *fileState) get(key string) *fileStateValue {
+	v, ok := f.Values[key]
+	if !ok || v.expired(time.Now()) {
+		return nil
+	}
+	return v
+}
+
+func (f *fileState) set(key, value string, ttl time.Duration) {
+	v := &fileStateValue{Value: value}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		v.ExpiresAt = &expiresAt
+	}
+	f.Values[key] = v
+}
+
+// fileBackend stores the state in a JSON file for the members on a single host.
+// The processes sharing the file are serialized by flock of the lock file.
+type fileBackend struct {
+	dir string
+}
+
+func newFileBackend(config *FileStateConfig) (*fileBackend, error) {
+	dir := defaultFileStateDir
+	if config != nil && config.Dir != "" {
+		dir = config.Dir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %s", err)
+	}
+	return &fileBackend{dir: dir}, nil
+}
+
+func (f *fileBackend) path() string {
+	return filepath.Join(f.dir, fileStateName)
+}
+
+func (f *fileBackend) load() (*fileState, error) {
+	state := &fileState{}
+	b, err := os.ReadFile(f.path())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, state); err != nil {
+			return nil, fmt.Errorf("invalid state file %s: %s", f.path(), err)
+		}
+	}
+	if state.Values == nil {
+		state.Values = map[string]*fileStateValue{}
+	}
+	if state.Sets == nil {
+		state.Sets = map[string][]string{}
+	}
+	return state, nil
+}
+
+// save drops the expired values and replaces the file atomically
+func (f *fileBackend) save(state *fileState) error {
+	now := time.Now()
+	for k, v := range state.Values {
+		if v.expired(now) {
+			delete(state.Values, k)
+		}
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path() + partialSuffix
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(b); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path())
+}
+
+// update runs fn under the exclusive lock and saves the state when fn reports a change
+func (f *fileBackend) update(ctx context.Context, fn func(state *fileState) (bool, error)) error {
+	ctx, cancel := withStateTimeout(ctx)
+	defer cancel()
+
+	lock, err := os.OpenFile(filepath.Join(f.dir, fileStateLockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := flock(ctx, lock); err != nil {
+		return err
+	}
+	// the lock is released by closing the file
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(state)
+	if err != nil || !changed {
+		return err
+	}
+	return f.save(state)
+}
+
+// flock waits for the exclusive lock of the file until the context is done
+func flock(ctx context.Context, file *os.File) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to lock state file: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (f *fileBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	var ret []byte
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		v := state.get(key)
+		if v == nil {
+			return false, ErrStateNotFound
+		}
+		ret = []byte(v.Value)
+		return false, nil
+	})
+	return ret, err
+}
+
+func (f *fileBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return f.update(ctx, func(state *fileState) (bool, error) {
+		state.set(key, string(value), ttl)
+		return true, nil
+	})
+}
+
+func (f *fileBackend) SetAll(ctx context.Context, values map[string][]byte) error {
+	return f.update(ctx, func(state *fileState) (bool, error) {
+		for k, v := range values {
+			state.set(k, string(v), 0)
+		}
+		return true, nil
+	})
+}
+
+func (f *fileBackend) Swap(ctx context.Context, key string, value []byte) ([]byte, error) {
+	var ret []byte
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		if v := state.get(key); v != nil {
+			ret = []byte(v.Value)
+		}
+		state.set(key, string(value), 0)
+		return true, nil
+	})
+	return ret, err
+}
+
+func (f *fileBackend) Delete(ctx context.Context, keys ...string) error {
+	return f.update(ctx, func(state *fileState) (bool, error) {
+		for _, k := range keys {
+			delete(state.Values, k)
+		}
+		return true, nil
+	})
+}
+
+func (f *fileBackend) TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ok := false
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		if state.get(key) != nil {
+			return false, nil
+		}
+		state.set(key, holder, ttl)
+		ok = true
+		return true, nil
+	})
+	return ok, err
+}
+
+func (f *fileBackend) ExtendLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ok := false
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		if v := state.get(key); v == nil || v.Value != holder {
+			return false, nil
+		}
+		state.set(key, holder, ttl)
+		ok = true
+		return true, nil
+	})
+	return ok, err
+}
+
+func (f *fileBackend) Unlock(ctx context.Context, key, holder string) (bool, error) {
+	ok := false
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		if v := state.get(key); v == nil || v.Value != holder {
+			return false, nil
+		}
+		delete(state.Values, key)
+		ok = true
+		return true, nil
+	})
+	return ok, err
+}
+
+func (f *fileBackend) Incr(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		if v := state.get(key); v != nil {
+			var err error
+			n, err = strconv.ParseInt(v.Value, 10, 64)
+			if err != nil {
+				return false, fmt.Errorf("invalid counter %s: %s", key, err)
+			}
+		}
+		n++
+		state.set(key, strconv.FormatInt(n, 10), 0)
+		return true, nil
+	})
+	return n, err
+}
+
+func (f *fileBackend) SetAllIfLocked(ctx context.Context, lockKey, holder string, values map[string][]byte, members map[string][]string) (bool, error) {
+	ok := false
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		if v := state.get(lockKey); v == nil || v.Value != holder {
+			return false, nil
+		}
+		for k, v := range values {
+			state.set(k, string(v), 0)
+		}
+		for k, ms := range members {
+			for _, m := range ms {
+				if !slices.Contains(state.Sets[k], m) {
+					state.Sets[k] = append(state.Sets[k], m)
+				}
+			}
+		}
+		ok = true
+		return true, nil
+	})
+	return ok, err
+}
+
+func (f *fileBackend) AddToSet(ctx context.Context, key string, members ...string) error {
+	return f.update(ctx, func(state *fileState) (bool, error) {
+		changed := false
+		for _, m := range members {
+			if !slices.Contains(state.Sets[key], m) {
+				state.Sets[key] = append(state.Sets[key], m)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+func (f *fileBackend) SetMembers(ctx context.Context, key string) ([]string, error) {
+	var ret []string
+	err := f.update(ctx, func(state *fileState) (bool, error) {
+		ret = slices.Clone(state.Sets[key])
+		return false, nil
+	})
+	return ret, err
+}
+
+func (f *fileBackend) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	return f.update(ctx, func(state *fileState) (bool, error) {
+		n := len(state.Sets[key])
+		state.Sets[key] = slices.DeleteFunc(state.Sets[key], func(m string) bool {
+			return slices.Contains(members, m)
+		})
+		if len(state.Sets[key]) == 0 {
+			delete(state.Sets, key)
+		}
+		return len(state.Sets[key]) != n, nil
+	})
+}
+
+// Close does nothing, the file is opened only during an operation
+func (f *fileBackend) Close() error {
+	return nil
+}
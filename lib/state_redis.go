@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+type redisBackend struct {
+	client redis.UniversalClient
+}
+
+// redisOptions returns the options of a standalone, sentinel(master_name) or cluster client
+func redisOptions(config *RedisConfig) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            config.Addrs,
+		MasterName:       config.MasterName,
+		SentinelPassword: config.SentinelPassword,
+		Username:         config.Username,
+		Password:         config.Password,
+		DB:               config.DB,
+	}
+	if len(opts.Addrs) == 0 {
+		opts.Addrs = []string{fmt.Sprintf("%s:%d", config.Host, config.Port)}
+	}
+
+	if config.TLS || config.TLSCACert != "" || config.TLSClientCert != "" {
+		tlsConfig, err := newTLSConfig(config.TLSCACert, config.TLSClientCert, config.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = config.TLSServerName
+		opts.TLSConfig = tlsConfig
+	}
+	return opts, nil
+}
+
+// isCluster reports whether the universal client connects to a cluster, it does so for multiple addrs without master_name
+func (c *RedisConfig) isCluster() bool {
+	return c.Cluster || (c.MasterName == "" && len(c.Addrs) > 1)
+}
+
+func newRedisBackend(config *RedisConfig) (*redisBackend, error) {
+	if config == nil {
+		return nil, fmt.Errorf("redis is not configured")
+	}
+	opts, err := redisOptions(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create redis client: %s", err)
+	}
+
+	var rc redis.UniversalClient
+	if config.Cluster {
+		// the universal client is a cluster client only with multiple addrs, a managed cluster has a single endpoint
+		rc = redis.NewClusterClient(opts.Cluster())
+	} else {
+		rc = redis.NewUniversalClient(opts)
+	}
+
+	if err := rc.Ping(context.Background()).Err(); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to create redis client: %s", err)
+	}
+	return &redisBackend{client: rc}, nil
+}
+
+func (r *redisBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrStateNotFound
+	}
+	return b, err
+}
+
+func (r *redisBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *redisBackend) SetAll(ctx context.Context, values map[string][]byte) error {
+	pipe := r.client.TxPipeline()
+	for k, v := range values {
+		pipe.Set(ctx, k, v, 0)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisBackend) Swap(ctx context.Context, key string, value []byte) ([]byte, error) {
+	b, err := r.client.GetSet(ctx, key, value).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (r *redisBackend) Delete(ctx context.Context, keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
+func (r *redisBackend) TryLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, key, holder, ttl).Result()
+}
+
+// extend the lease only when this member still holds it
+var extendLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func (r *redisBackend) ExtendLock(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	n, err := extendLeaseScript.Run(ctx, r.client, []string{key}, holder, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// delete the lock only when this member still holds it
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (r *redisBackend) Unlock(ctx context.Context, key, holder string) (bool, error) {
+	n, err := unlockScript.Run(ctx, r.client, []string{key}, holder).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// set the values(ARGV[3:n+2]) and add the members(ARGV[n+3:]) only when this member still holds the lock
+var setAllIfLockedScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local n = tonumber(ARGV[2])
+for i = 2, n + 1 do
+	redis.call("SET", KEYS[i], ARGV[i + 1])
+end
+for i = n + 2, #KEYS do
+	redis.call("SADD", KEYS[i], ARGV[i + 1])
+end
+return 1
+`)
+
+func (r *redisBackend) SetAllIfLocked(ctx context.Context, lockKey, holder string, values map[string][]byte, members map[string][]string) (bool, error) {
+	keys := []string{lockKey}
+	args := []any{holder, len(values)}
+	for k, v := range values {
+		keys = append(keys, k)
+		args = append(args, v)
+	}
+	for k, ms := range members {
+		for _, m := range ms {
+			keys = append(keys, k)
+			args = append(args, m)
+		}
+	}
+	n, err := setAllIfLockedScript.Run(ctx, r.client, keys, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (r *redisBackend) Incr(ctx context.Context, key string) (int64, error) {
+	return r.client.Incr(ctx, key).Result()
+}
+
+func (r *redisBackend) AddToSet(ctx context.Context, key string, members ...string) error {
+	return r.client.SAdd(ctx, key, members).Err()
+}
+
+func (r *redisBackend) SetMembers(ctx context.Context, key string) ([]string, error) {
+	return r.client.SMembers(ctx, key).Result()
+}
+
+func (r *redisBackend) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	return r.client.SRem(ctx, key, members).Err()
+}
+
+func (r *redisBackend) Close() error {
+	return r.client.Close()
+}
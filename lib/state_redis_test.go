@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestRedisOptions(t *testing.T) {
+	opts, err := redisOptions(&RedisConfig{Host: "127.0.0.1", Port: 6379, DB: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:6379"}, opts.Addrs)
+	assert.Nil(t, opts.TLSConfig)
+
+	opts, err = redisOptions(&RedisConfig{
+		Host:          "127.0.0.1",
+		Port:          6379,
+		Addrs:         []string{"sentinel1:26379", "sentinel2:26379"},
+		MasterName:    "mymaster",
+		Username:      "gacr",
+		Password:      "password",
+		TLS:           true,
+		TLSServerName: "redis.example.com",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sentinel1:26379", "sentinel2:26379"}, opts.Addrs)
+	assert.Equal(t, "mymaster", opts.MasterName)
+	assert.Equal(t, "gacr", opts.Username)
+	assert.Equal(t, "redis.example.com", opts.TLSConfig.ServerName)
+
+	_, err = redisOptions(&RedisConfig{Host: "127.0.0.1", Port: 6379, TLSCACert: "testdata/missing.pem"})
+	assert.Error(t, err)
+}
+
+func TestStateKeyPrefixRedisCluster(t *testing.T) {
+	testCases := []struct {
+		name  string
+		redis *RedisConfig
+		want  string
+	}{
+		{
+			name:  "standalone",
+			redis: &RedisConfig{KeyPrefix: "prefix"},
+			want:  "prefix",
+		},
+		{
+			name:  "cluster",
+			redis: &RedisConfig{Cluster: true},
+			want:  "{foo/bar}",
+		},
+		{
+			name:  "cluster by addrs",
+			redis: &RedisConfig{Addrs: []string{"node1:6379", "node2:6379"}, KeyPrefix: "prefix"},
+			want:  "{prefix}",
+		},
+		{
+			name:  "sentinel",
+			redis: &RedisConfig{Addrs: []string{"sentinel1:26379", "sentinel2:26379"}, MasterName: "mymaster"},
+			want:  "foo/bar",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, stateKeyPrefix(&Config{Repo: "foo/bar", Redis: tc.redis}))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package lib
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -74,3 +75,120 @@ func TestGetRolloutProgress(t *testing.T) {
 	assert.Equal(t, 0, installed)
 	assert.Equal(t, 1, all)
 }
+
+func TestCanInstallTagDowngrade(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	now := time.Now()
+	testCases := []struct {
+		name              string
+		stableTag         string
+		stablePublishedAt time.Time
+		tag               string
+		publishedAt       time.Time
+		allowDowngradeTo  string
+		wantErr           error
+	}{
+		{
+			name:      "upgrade",
+			stableTag: "v1.2.0",
+			tag:       "v1.3.0",
+		},
+		{
+			name:      "downgrade",
+			stableTag: "v1.2.0",
+			tag:       "v1.1.0",
+			wantErr:   ErrDowngrade,
+		},
+		{
+			name:             "allowed downgrade",
+			stableTag:        "v1.2.0",
+			tag:              "v1.1.0",
+			allowDowngradeTo: "v1.1.0",
+		},
+		{
+			name:      "not semver",
+			stableTag: "stable",
+			tag:       "latest",
+		},
+		{
+			name:              "not semver published later",
+			stableTag:         "stable",
+			stablePublishedAt: now.Add(-time.Hour),
+			tag:               "latest",
+			publishedAt:       now,
+		},
+		{
+			name:              "not semver published before",
+			stableTag:         "stable",
+			stablePublishedAt: now,
+			tag:               "latest",
+			publishedAt:       now.Add(-time.Hour),
+			wantErr:           ErrDowngrade,
+		},
+		{
+			name:              "semver stable and not semver tag published before",
+			stableTag:         "v1.2.0",
+			stablePublishedAt: now,
+			tag:               "nightly",
+			publishedAt:       now.Add(-time.Hour),
+			wantErr:           ErrDowngrade,
+		},
+		{
+			name:              "allowed downgrade published before",
+			stableTag:         "stable",
+			stablePublishedAt: now,
+			tag:               "latest",
+			publishedAt:       now.Add(-time.Hour),
+			allowDowngradeTo:  "latest",
+		},
+		{
+			name: "no stable tag",
+			tag:  "v0.1.0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.AllowDowngradeTo = tc.allowDowngradeTo
+			state, err := NewState(config)
+			if err != nil {
+				t.Fatalf("failed to setup test: %v", err)
+			}
+			redisClient.Del(context.Background(), state.stableReleaseTagKey, state.stableReleaseKey, state.avoidReleaseTagKey)
+			if !tc.stablePublishedAt.IsZero() {
+				assert.NoError(t, state.SaveStableRelease(&ReleaseInfo{Tag: tc.stableTag, PublishedAt: tc.stablePublishedAt}))
+			} else if tc.stableTag != "" {
+				redisClient.Set(context.Background(), state.stableReleaseTagKey, tc.stableTag, 0)
+			}
+
+			err = state.CanInstallRelease(&ReleaseInfo{Tag: tc.tag, PublishedAt: tc.publishedAt})
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckReleaseSettled(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	state, err := NewState(newTestConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, redisClient.Del(context.Background(), state.settlingReleaseKey).Err())
+
+	// published just now
+	info := &ReleaseInfo{Tag: "v1.0.0", AssetSet: "a", PublishedAt: time.Now().Add(-time.Minute)}
+	assert.True(t, errors.Is(state.CheckReleaseSettled(info, 10*time.Minute), ErrReleaseSettling))
+
+	// published long ago
+	info = &ReleaseInfo{Tag: "v1.1.0", AssetSet: "a", PublishedAt: time.Now().Add(-time.Hour)}
+	assert.NoError(t, state.CheckReleaseSettled(info, 10*time.Minute))
+
+	// the wait starts over when the assets changed
+	info.AssetSet = "b"
+	assert.True(t, errors.Is(state.CheckReleaseSettled(info, 10*time.Minute), ErrReleaseSettling))
+	assert.True(t, errors.Is(state.CheckReleaseSettled(info, 10*time.Minute), ErrReleaseSettling))
+	assert.NoError(t, state.CheckReleaseSettled(info, 0))
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newHTTPTransport returns the transport of the release sources with the custom CA, client certificate and proxy settings
+func newHTTPTransport(config *Config) (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// the body of an asset is bounded by download_timeout, a stalled server is detected before it
+	tr.ResponseHeaderTimeout = defaultRequestTimeout
+	if config.RequestTimeout > 0 {
+		tr.ResponseHeaderTimeout = config.RequestTimeout
+	}
+
+	if config.TLSCACert != "" || config.TLSClientCert != "" {
+		tlsConfig, err := newTLSConfig(config.TLSCACert, config.TLSClientCert, config.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+
+	if config.HTTPProxy != "" {
+		if _, err := url.Parse(config.HTTPProxy); err != nil {
+			return nil, fmt.Errorf("invalid http proxy: %s", err)
+		}
+		proxy := (&httpproxy.Config{
+			HTTPProxy:  config.HTTPProxy,
+			HTTPSProxy: config.HTTPProxy,
+			NoProxy:    config.NoProxy,
+		}).ProxyFunc()
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		}
+	}
+	return tr, nil
+}
+
+// newTLSConfig returns the tls config trusting the CA in addition to the system CAs, with the client certificate for mTLS
+func newTLSConfig(caCert, clientCert, clientKey string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca certificate: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate is found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}